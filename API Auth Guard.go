@@ -0,0 +1,174 @@
+/*
+File Name:  API Auth Guard.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Brute-force protection of the API key authentication. Failed attempts are tracked per remote IP address.
+After each failure the address must wait before the next attempt, doubling with each failure. After too many failures the address is locked out temporarily.
+Requests without API key are refused but not counted as failure, so that clients such as health checks without key do not lock out other local clients.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// Defaults of the brute-force protection.
+const (
+	apiAuthMaxFailuresDefault = 5                // Count of failures after which the address is locked out.
+	apiAuthBackoffDefault     = time.Second      // Wait time after the first failure. It doubles with each further failure.
+	apiAuthLockoutDefault     = 15 * time.Minute // Duration of the lockout.
+)
+
+// Counters for metrics. They are not reset when the API is restarted.
+var metricAuthFailures, metricAuthLockouts uint64
+
+// apiAuthGuard tracks failed authentication attempts per remote IP address.
+type apiAuthGuard struct {
+	backend     *core.Backend
+	maxFailures int
+	backoff     time.Duration
+	lockout     time.Duration
+	now         func() time.Time // Returns the current time. Tests may replace it.
+
+	sync.Mutex
+	addresses map[string]*apiAuthFailures
+}
+
+// apiAuthFailures is the state of a single remote IP address.
+type apiAuthFailures struct {
+	count        int       // Count of failures since the last success or lockout.
+	last         time.Time // Time of the last failure.
+	blockedUntil time.Time // Requests are refused until this time.
+}
+
+// apiGuard is the brute-force protection of the API. It is kept when the API is restarted with reloaded settings, so that a reload does not reset lockouts.
+var apiGuard *apiAuthGuard
+var apiGuardMutex sync.Mutex
+
+// newAPIAuthGuard creates a new brute-force protection. Zero values use the defaults.
+func newAPIAuthGuard(backend *core.Backend, maxFailures int, backoff, lockout time.Duration) (guard *apiAuthGuard) {
+	guard = &apiAuthGuard{backend: backend, now: time.Now, addresses: make(map[string]*apiAuthFailures)}
+	guard.setLimits(maxFailures, backoff, lockout)
+	return guard
+}
+
+// apiAuthGuardInstance returns the brute-force protection of the API. It is created on first use. The limits are updated with each call, the tracked addresses remain.
+func apiAuthGuardInstance(backend *core.Backend, maxFailures int, backoff, lockout time.Duration) *apiAuthGuard {
+	apiGuardMutex.Lock()
+	defer apiGuardMutex.Unlock()
+
+	if apiGuard == nil {
+		apiGuard = newAPIAuthGuard(backend, maxFailures, backoff, lockout)
+	} else {
+		apiGuard.setLimits(maxFailures, backoff, lockout)
+	}
+
+	return apiGuard
+}
+
+// setLimits sets the count of failures until the lockout, the backoff after the first failure and the duration of the lockout. Zero values use the defaults.
+// Addresses that are currently blocked remain blocked until their previous time.
+func (guard *apiAuthGuard) setLimits(maxFailures int, backoff, lockout time.Duration) {
+	if maxFailures <= 0 {
+		maxFailures = apiAuthMaxFailuresDefault
+	}
+	if backoff <= 0 {
+		backoff = apiAuthBackoffDefault
+	}
+	if lockout <= 0 {
+		lockout = apiAuthLockoutDefault
+	}
+
+	guard.Lock()
+	guard.maxFailures, guard.backoff, guard.lockout = maxFailures, backoff, lockout
+	guard.Unlock()
+}
+
+// apiRemoteIP returns the IP address of the remote address. Requests via Unix domain sockets share the same remote address.
+func apiRemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// blocked returns the remaining time the address must wait before it may try again. 0 if not blocked.
+func (guard *apiAuthGuard) blocked(ip string) (wait time.Duration) {
+	guard.Lock()
+	defer guard.Unlock()
+
+	if failures, ok := guard.addresses[ip]; ok {
+		if wait = failures.blockedUntil.Sub(guard.now()); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// failure records a failed attempt. After each failure the address is blocked for the backoff time, which doubles with each failure.
+// If the maximum count of failures is reached, the address is locked out.
+func (guard *apiAuthGuard) failure(ip string) {
+	atomic.AddUint64(&metricAuthFailures, 1)
+
+	guard.Lock()
+	defer guard.Unlock()
+
+	now := guard.now()
+	guard.purge(now)
+
+	failures, ok := guard.addresses[ip]
+	if !ok {
+		failures = &apiAuthFailures{}
+		guard.addresses[ip] = failures
+	}
+
+	failures.count++
+	failures.last = now
+
+	if failures.count >= guard.maxFailures {
+		failures.count = 0
+		failures.blockedUntil = now.Add(guard.lockout)
+		atomic.AddUint64(&metricAuthLockouts, 1)
+
+		guard.backend.LogError("apiAuthGuard", "remote address '%s' locked out for %s after %d failed API key attempts\n", ip, guard.lockout.String(), guard.maxFailures)
+		return
+	}
+
+	wait := guard.backoff << (failures.count - 1)
+	if wait <= 0 || wait > guard.lockout {
+		wait = guard.lockout
+	}
+	failures.blockedUntil = now.Add(wait)
+}
+
+// success resets the failures of the address.
+func (guard *apiAuthGuard) success(ip string) {
+	guard.Lock()
+	delete(guard.addresses, ip)
+	guard.Unlock()
+}
+
+// purge removes addresses that are not blocked and whose last failure is older than the lockout duration. The guard must be locked.
+func (guard *apiAuthGuard) purge(now time.Time) {
+	for ip, failures := range guard.addresses {
+		if now.After(failures.blockedUntil) && now.Sub(failures.last) > guard.lockout {
+			delete(guard.addresses, ip)
+		}
+	}
+}
+
+// refuse answers the request with 429 and the time to wait in the Retry-After header.
+func (guard *apiAuthGuard) refuse(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
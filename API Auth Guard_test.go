@@ -0,0 +1,188 @@
+/*
+File Name:  API Auth Guard_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Tests of the brute-force protection of the API key authentication. The clock of the guard is replaced so that no test waits.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PeernetOfficial/core/webapi"
+	"github.com/google/uuid"
+)
+
+// testClock is a manually advanced clock.
+type testClock struct {
+	current time.Time
+}
+
+func (clock *testClock) now() time.Time {
+	return clock.current
+}
+
+func (clock *testClock) advance(duration time.Duration) {
+	clock.current = clock.current.Add(duration)
+}
+
+// testAuthGuard returns a guard with the default limits that uses the test clock.
+func testAuthGuard(t *testing.T) (guard *apiAuthGuard, clock *testClock) {
+	clock = &testClock{current: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	guard = newAPIAuthGuard(testBackend(t), 0, 0, 0)
+	guard.now = clock.now
+	return guard, clock
+}
+
+// TestAPIAuthGuardBackoff checks that the wait time doubles with each failure and that the address is locked out after 5 failures.
+func TestAPIAuthGuardBackoff(t *testing.T) {
+	guard, clock := testAuthGuard(t)
+	const ip = "192.0.2.1"
+
+	if wait := guard.blocked(ip); wait != 0 {
+		t.Fatalf("blocked before any failure: %s", wait)
+	}
+
+	for n, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		guard.failure(ip)
+		if wait := guard.blocked(ip); wait != expected {
+			t.Fatalf("failure %d: got wait %s, want %s", n+1, wait, expected)
+		}
+
+		clock.advance(expected)
+		if wait := guard.blocked(ip); wait != 0 {
+			t.Fatalf("failure %d: still blocked after the wait time: %s", n+1, wait)
+		}
+	}
+
+	// Other addresses are not affected.
+	if wait := guard.blocked("192.0.2.2"); wait != 0 {
+		t.Fatalf("other address blocked: %s", wait)
+	}
+
+	lockouts := atomic.LoadUint64(&metricAuthLockouts)
+	guard.failure(ip)
+	if wait := guard.blocked(ip); wait != apiAuthLockoutDefault {
+		t.Fatalf("5th failure: got wait %s, want lockout %s", wait, apiAuthLockoutDefault)
+	} else if atomic.LoadUint64(&metricAuthLockouts) != lockouts+1 {
+		t.Fatal("lockout not counted")
+	}
+
+	// lockout expiry
+	clock.advance(apiAuthLockoutDefault - time.Second)
+	if wait := guard.blocked(ip); wait != time.Second {
+		t.Fatalf("got wait %s before the lockout expired, want 1s", wait)
+	}
+	clock.advance(time.Second)
+	if wait := guard.blocked(ip); wait != 0 {
+		t.Fatalf("still blocked after the lockout expired: %s", wait)
+	}
+
+	// The count of failures starts again after the lockout.
+	guard.failure(ip)
+	if wait := guard.blocked(ip); wait != time.Second {
+		t.Fatalf("failure after lockout: got wait %s, want 1s", wait)
+	}
+
+	// success resets the failures
+	clock.advance(time.Second)
+	guard.success(ip)
+	guard.failure(ip)
+	if wait := guard.blocked(ip); wait != time.Second {
+		t.Fatalf("failure after success: got wait %s, want 1s", wait)
+	}
+}
+
+// TestAPIAuthGuardPurge checks that addresses are removed once they are not blocked anymore and their last failure is older than the lockout duration.
+func TestAPIAuthGuardPurge(t *testing.T) {
+	guard, clock := testAuthGuard(t)
+
+	guard.failure("192.0.2.1")
+	clock.advance(apiAuthLockoutDefault + time.Second)
+	guard.failure("192.0.2.2")
+
+	guard.Lock()
+	_, exists := guard.addresses["192.0.2.1"]
+	count := len(guard.addresses)
+	guard.Unlock()
+
+	if exists || count != 1 {
+		t.Fatalf("expired address not removed, %d addresses tracked", count)
+	}
+}
+
+// TestAPIAuthGuardRequests checks the guard via the authentication middleware: 429 with Retry-After for blocked addresses, and requests without key are not counted.
+func TestAPIAuthGuardRequests(t *testing.T) {
+	guard, clock := testAuthGuard(t)
+
+	key := uuid.MustParse("00000000-0000-4000-8000-000000000001")
+	keys, _ := apiKeysLoad(key, nil)
+	handler := apiAuthenticate(&webapi.WebapiInstance{}, keys, &apiSettings{}, guard)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(remote, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.RemoteAddr = remote
+		if key != "" {
+			r.Header.Set("x-api-key", key)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	// Requests without key are refused, but not counted as failure.
+	for n := 0; n < 2*apiAuthMaxFailuresDefault; n++ {
+		if code := request("192.0.2.1:1000", "").Code; code != http.StatusUnauthorized {
+			t.Fatalf("request %d without key: got status %d, want 401", n+1, code)
+		}
+	}
+	if wait := guard.blocked("192.0.2.1"); wait != 0 {
+		t.Fatalf("requests without key blocked the address for %s", wait)
+	}
+
+	// Failed attempts until the lockout. The remote port does not matter.
+	for n := 0; n < apiAuthMaxFailuresDefault; n++ {
+		if code := request("192.0.2.1:"+strconv.Itoa(2000+n), uuid.New().String()).Code; code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: got status %d, want 401", n+1, code)
+		}
+
+		if n < apiAuthMaxFailuresDefault-1 {
+			// During the backoff even the valid key is refused.
+			recorder := request("192.0.2.1:1000", key.String())
+			if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+				t.Fatalf("failure %d: request during backoff got status %d, Retry-After '%s'", n+1, recorder.Code, recorder.Header().Get("Retry-After"))
+			}
+			clock.advance(guard.blocked("192.0.2.1"))
+		}
+	}
+
+	recorder := request("192.0.2.1:1000", key.String())
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked out: got status %d, want 429", recorder.Code)
+	} else if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "901" {
+		t.Fatalf("locked out: got Retry-After '%s', want 901", retryAfter)
+	}
+
+	// Malformed keys are counted as well, other addresses are not affected.
+	if code := request("192.0.2.2:1000", key.String()).Code; code != http.StatusOK {
+		t.Fatalf("other address: got status %d, want 200", code)
+	}
+	if code := request("192.0.2.2:1000", "invalid").Code; code != http.StatusUnauthorized {
+		t.Fatalf("malformed key: got status %d, want 401", code)
+	} else if wait := guard.blocked("192.0.2.2"); wait != time.Second {
+		t.Fatalf("malformed key: got wait %s, want 1s", wait)
+	}
+
+	// After the lockout the valid key is accepted again.
+	clock.advance(apiAuthLockoutDefault)
+	if code := request("192.0.2.1:1000", key.String()).Code; code != http.StatusOK {
+		t.Fatalf("after lockout: got status %d, want 200", code)
+	}
+}
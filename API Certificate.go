@@ -0,0 +1,253 @@
+/*
+File Name:  API Certificate.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Certificate of the API when SSL is enabled. If the certificate files do not exist, a self-signed certificate for the listen addresses is created.
+Self-signed certificates are renewed before they expire. The SHA-256 fingerprint is printed so that frontends can pin the certificate.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// apiCertificateCommonName is the common name of self-signed certificates. It identifies certificates created by this application which may be renewed.
+const apiCertificateCommonName = appName + " API"
+
+// apiCertificateValidity is the validity of self-signed certificates.
+const apiCertificateValidity = 365 * 24 * time.Hour
+
+// apiCertificateRenewBefore is the remaining validity at which self-signed certificates are renewed.
+const apiCertificateRenewBefore = 30 * 24 * time.Hour
+
+// apiCertificate provides the certificate for TLS connections to the API.
+type apiCertificate struct {
+	backend         *core.Backend
+	certificateFile string   // Certificate file in PEM format.
+	keyFile         string   // Private key file in PEM format.
+	hosts           []string // IPs and host names that a self-signed certificate is created for.
+	selfSigned      bool     // Whether the certificate was created by this application and is renewed automatically.
+
+	sync.Mutex
+	current *tls.Certificate
+}
+
+// apiCertificateFilenames returns the default certificate and key file for self-signed certificates, next to the config file.
+// For example "Config.api.crt" and "Config.api.key" for "Config.yaml".
+func apiCertificateFilenames() (certificateFile, keyFile string) {
+	base := strings.TrimSuffix(configFile, filepath.Ext(configFile))
+	return base + ".api.crt", base + ".api.key"
+}
+
+// apiCertificateLoad loads the certificate. If the certificate and key file do not exist, a self-signed certificate is created.
+// If the file names are empty, the default file names are used. If only one of the specified files exists, an error is returned and the files are not modified,
+// since an existing certificate may have been issued by a CA. With the default file names a missing file is recreated, as the files are owned by this application.
+func apiCertificateLoad(backend *core.Backend, listenAddresses []string, certificateFile, keyFile string) (certificate *apiCertificate, err error) {
+	defaultFiles := certificateFile == "" && keyFile == ""
+	if defaultFiles {
+		certificateFile, keyFile = apiCertificateFilenames()
+	} else if certificateFile == "" || keyFile == "" {
+		return nil, errors.New("both the certificate file and the key file must be specified")
+	}
+
+	certificate = &apiCertificate{backend: backend, certificateFile: certificateFile, keyFile: keyFile, hosts: apiCertificateHosts(listenAddresses)}
+
+	_, errCertificate := os.Stat(certificateFile)
+	_, errKey := os.Stat(keyFile)
+	missingCertificate, missingKey := os.IsNotExist(errCertificate), os.IsNotExist(errKey)
+
+	switch {
+	case missingCertificate && missingKey, defaultFiles && (missingCertificate || missingKey):
+		return certificate, certificate.renew()
+	case missingCertificate:
+		return nil, fmt.Errorf("certificate file '%s' does not exist, but key file '%s' exists", certificateFile, keyFile)
+	case missingKey:
+		return nil, fmt.Errorf("key file '%s' does not exist, but certificate file '%s' exists", keyFile, certificateFile)
+	}
+
+	loaded, err := tls.LoadX509KeyPair(certificateFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	certificate.current = &loaded
+
+	if parsed, err := x509.ParseCertificate(loaded.Certificate[0]); err == nil {
+		certificate.selfSigned = parsed.Subject.CommonName == apiCertificateCommonName && parsed.CheckSignature(parsed.SignatureAlgorithm, parsed.RawTBSCertificate, parsed.Signature) == nil
+
+		// A self-signed certificate is renewed if it expires soon or does not cover the current listen addresses.
+		// Previous versions created it as CA certificate, which must not be trusted as root by frontends.
+		if certificate.selfSigned && (certificate.expiresSoon(parsed) || !apiCertificateCovers(parsed, certificate.hosts) || parsed.IsCA) {
+			return certificate, certificate.renew()
+		}
+	}
+
+	fingerprint := apiCertificateFingerprint(loaded.Certificate[0])
+	backend.LogError("apiCertificateLoad", "using API certificate '%s' with SHA-256 fingerprint %s\n", certificateFile, fingerprint)
+	fmt.Fprintf(backend.Stdout, "API certificate SHA-256 fingerprint:\n%s\n", fingerprint)
+
+	return certificate, nil
+}
+
+// getCertificate returns the current certificate. It is used as GetCertificate function in the TLS config.
+// Self-signed certificates are renewed if they expire soon.
+func (certificate *apiCertificate) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate.Lock()
+	defer certificate.Unlock()
+
+	if certificate.selfSigned {
+		if parsed, err := x509.ParseCertificate(certificate.current.Certificate[0]); err == nil && certificate.expiresSoon(parsed) {
+			if err := certificate.renewLocked(); err != nil {
+				certificate.backend.LogError("apiCertificate.getCertificate", "error renewing self-signed certificate: %v\n", err)
+			}
+		}
+	}
+
+	return certificate.current, nil
+}
+
+func (certificate *apiCertificate) expiresSoon(parsed *x509.Certificate) bool {
+	return time.Until(parsed.NotAfter) < apiCertificateRenewBefore
+}
+
+// renew creates a new self-signed certificate and stores it in the files.
+func (certificate *apiCertificate) renew() (err error) {
+	certificate.Lock()
+	defer certificate.Unlock()
+
+	return certificate.renewLocked()
+}
+
+func (certificate *apiCertificate) renewLocked() (err error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: apiCertificateCommonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(apiCertificateValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, host := range certificate.hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err = os.WriteFile(certificate.keyFile, keyPEM, 0600); err != nil {
+		return err
+	} else if err = os.WriteFile(certificate.certificateFile, certificatePEM, 0644); err != nil {
+		return err
+	}
+
+	created, err := tls.X509KeyPair(certificatePEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	certificate.current = &created
+	certificate.selfSigned = true
+
+	fingerprint := apiCertificateFingerprint(certificateDER)
+	certificate.backend.LogError("apiCertificate.renew", "created self-signed API certificate '%s' valid until %s with SHA-256 fingerprint %s\n", certificate.certificateFile, template.NotAfter.Format(dateFormat), fingerprint)
+	fmt.Fprintf(certificate.backend.Stdout, "Created self-signed API certificate with SHA-256 fingerprint:\n%s\n", fingerprint)
+
+	return nil
+}
+
+// apiCertificateHosts returns the IPs and host names of the listen addresses. Listening on any IP is covered by the loopback IPs.
+func apiCertificateHosts(listenAddresses []string) (hosts []string) {
+	unique := make(map[string]struct{})
+	add := func(host string) {
+		if _, ok := unique[host]; !ok {
+			unique[host] = struct{}{}
+			hosts = append(hosts, host)
+		}
+	}
+
+	add("localhost")
+
+	for _, listen := range listenAddresses {
+		host, _, err := net.SplitHostPort(listen)
+		if err != nil {
+			continue
+		}
+
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			add("127.0.0.1")
+			add("::1")
+		} else if ip != nil {
+			add(ip.String())
+		} else {
+			add(host)
+		}
+	}
+
+	return hosts
+}
+
+// apiCertificateCovers checks if the certificate is valid for all hosts.
+func apiCertificateCovers(parsed *x509.Certificate, hosts []string) bool {
+	for _, host := range hosts {
+		if parsed.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// apiCertificateFingerprint returns the SHA-256 fingerprint of the certificate as uppercase hex bytes separated by colons.
+func apiCertificateFingerprint(certificateDER []byte) string {
+	hash := sha256.Sum256(certificateDER)
+
+	var parts []string
+	for _, b := range hash {
+		parts = append(parts, fmt.Sprintf("%02X", b))
+	}
+	return strings.Join(parts, ":")
+}
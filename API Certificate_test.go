@@ -0,0 +1,127 @@
+/*
+File Name:  API Certificate_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Tests of the self-signed API certificate.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificateParse returns the parsed certificate from the file.
+func testCertificateParse(t *testing.T, filename string) *x509.Certificate {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("no PEM block in '%s'", filename)
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// testCertificateWrite writes a self-signed certificate with the common name that expires at the given time.
+func testCertificateWrite(t *testing.T, certificateFile, keyFile, commonName string, notAfter time.Time) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certificateFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER}), 0644); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAPICertificate checks that a self-signed certificate is created, reused, and renewed if it expires within 30 days.
+func TestAPICertificate(t *testing.T) {
+	backend := testBackend(t)
+	folder := t.TempDir()
+	certificateFile, keyFile := filepath.Join(folder, "api.crt"), filepath.Join(folder, "api.key")
+	listen := []string{"127.0.0.1:112"}
+
+	// create
+	certificate, err := apiCertificateLoad(backend, listen, certificateFile, keyFile)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	} else if !certificate.selfSigned {
+		t.Fatal("created certificate not detected as self-signed")
+	}
+
+	created := testCertificateParse(t, certificateFile)
+	if created.IsCA || created.KeyUsage&x509.KeyUsageCertSign != 0 {
+		t.Fatal("created certificate may sign other certificates")
+	} else if created.VerifyHostname("127.0.0.1") != nil || created.VerifyHostname("localhost") != nil {
+		t.Fatal("created certificate does not cover the listen address")
+	}
+	createdPEM, _ := os.ReadFile(certificateFile)
+
+	// reuse
+	if certificate, err = apiCertificateLoad(backend, listen, certificateFile, keyFile); err != nil {
+		t.Fatalf("error loading certificate: %v", err)
+	} else if !certificate.selfSigned {
+		t.Fatal("loaded certificate not detected as self-signed")
+	} else if reusedPEM, _ := os.ReadFile(certificateFile); !bytes.Equal(createdPEM, reusedPEM) {
+		t.Fatal("valid certificate was replaced")
+	}
+
+	// renew if it expires within 30 days
+	testCertificateWrite(t, certificateFile, keyFile, apiCertificateCommonName, time.Now().Add(10*24*time.Hour))
+	if _, err = apiCertificateLoad(backend, listen, certificateFile, keyFile); err != nil {
+		t.Fatalf("error renewing certificate: %v", err)
+	} else if renewed := testCertificateParse(t, certificateFile); time.Until(renewed.NotAfter) < apiCertificateValidity-24*time.Hour {
+		t.Fatalf("certificate not renewed, expires %s", renewed.NotAfter)
+	}
+
+	// Certificates not created by this application are never renewed.
+	expires := time.Now().Add(10 * 24 * time.Hour)
+	testCertificateWrite(t, certificateFile, keyFile, "other", expires)
+	if certificate, err = apiCertificateLoad(backend, listen, certificateFile, keyFile); err != nil {
+		t.Fatalf("error loading certificate: %v", err)
+	} else if certificate.selfSigned {
+		t.Fatal("foreign certificate detected as created by this application")
+	} else if kept := testCertificateParse(t, certificateFile); kept.Subject.CommonName != "other" {
+		t.Fatal("foreign certificate was replaced")
+	}
+}
@@ -0,0 +1,75 @@
+/*
+File Name:  API Cmd.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+JSON endpoints under /cmd/ that provide the same information as the text commands. The structures are shared with the JSON output of commands.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/PeernetOfficial/core"
+)
+
+/*
+apiCmdStatus returns the status of this node including listening networks, feature bits and peers. Same as the "status" command.
+
+Request:    GET /cmd/status
+Result:     200 with JSON structure jsonStatus
+*/
+func apiCmdStatus(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := statusToJSON(backend)
+		EncodeJSONFlush(backend, w, r, &status)
+	}
+}
+
+/*
+apiCmdTransfers returns the list of file and block transfers. Same as the "transfer list" command.
+
+Request:    GET /cmd/transfers
+Result:     200 with JSON array of jsonTransfer
+*/
+func apiCmdTransfers(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		EncodeJSONFlush(backend, w, r, transfersToJSON(backend))
+	}
+}
+
+/*
+apiCmdPeerConnections returns the list of peers including their connections. Same as the "peer list" command.
+The optional node ID filters for a single peer.
+
+Request:    GET /cmd/peer/connections?nodeid=[node ID]
+Result:     200 with JSON array of jsonPeer
+
+	400 if the node ID is invalid
+*/
+func apiCmdPeerConnections(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		var nodeID []byte
+		if nodeIDA := r.Form.Get("nodeid"); nodeIDA != "" {
+			var err error
+			if nodeID, err = hex.DecodeString(nodeIDA); err != nil || len(nodeID) != 256/8 {
+				http.Error(w, "", http.StatusBadRequest)
+				return
+			}
+		}
+
+		peers := []jsonPeer{}
+		for _, peer := range GetPeerlistSorted(backend) {
+			if nodeID == nil || bytes.Equal(peer.NodeID, nodeID) {
+				peers = append(peers, peerToJSON(peer, true))
+			}
+		}
+
+		EncodeJSONFlush(backend, w, r, peers)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+File Name:  API Health.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Health endpoints for supervisors. /health reports whether the process is alive, /ready whether the node is usable.
+*/
+
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/PeernetOfficial/core"
+)
+
+/*
+apiHealth reports whether the application is alive (liveness check). It does not check the state of the node, use /ready for that.
+
+Request:    GET /health
+Result:     200 with JSON structure apiHealthStatus
+*/
+func apiHealth(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := apiHealthStatus{Status: "ok"}
+		if shutdownInProgress() {
+			status.Status = "shutdown"
+		}
+
+		EncodeJSONFlush(backend, w, r, &status)
+	}
+}
+
+type apiHealthStatus struct {
+	Status string `json:"status"` // "ok" if alive, "shutdown" if a shutdown is in progress.
+}
+
+/*
+apiReady reports whether the node is ready to be used (readiness check). The node is ready if the thresholds set in the config are met,
+at least one network is listening, the warehouse is accessible, and no shutdown is in progress.
+
+Request:    GET /ready
+Result:     200 with JSON structure apiReadyStatus if ready
+
+	503 with JSON structure apiReadyStatus if not ready
+*/
+func apiReady(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := apiReadyStatus{
+			Networks4:           len(backend.GetNetworks(4)),
+			Networks6:           len(backend.GetNetworks(6)),
+			WarehouseAccessible: warehouseAccessible(backend),
+			Shutdown:            shutdownInProgress(),
+		}
+
+		for _, peer := range backend.PeerlistGet() {
+			status.CountPeers++
+			if peer.IsRootPeer {
+				status.RootPeerConnected = true
+			}
+		}
+
+		minPeers := config.ReadyMinPeers
+		if minPeers <= 0 {
+			minPeers = 1
+		}
+
+		status.Ready = !status.Shutdown && status.WarehouseAccessible && status.Networks4+status.Networks6 > 0 &&
+			status.CountPeers >= minPeers && (status.RootPeerConnected || !config.ReadyRequireRootPeer)
+
+		statusCode := http.StatusOK
+		if !status.Ready {
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		EncodeJSONFlushStatus(backend, w, r, statusCode, &status)
+	}
+}
+
+type apiReadyStatus struct {
+	Ready               bool `json:"ready"`               // Whether the node is ready. If not, the HTTP status code is 503.
+	CountPeers          int  `json:"countpeers"`          // Count of peers.
+	RootPeerConnected   bool `json:"rootpeerconnected"`   // Whether a root peer is connected.
+	Networks4           int  `json:"networks4"`           // Count of IPv4 networks listening.
+	Networks6           int  `json:"networks6"`           // Count of IPv6 networks listening.
+	WarehouseAccessible bool `json:"warehouseaccessible"` // Whether the warehouse directory is accessible.
+	Shutdown            bool `json:"shutdown"`            // Whether a shutdown is in progress.
+}
+
+// warehouseAccessible checks if the directories of the user warehouse exist.
+func warehouseAccessible(backend *core.Backend) bool {
+	if backend.UserWarehouse == nil {
+		return false
+	}
+
+	for _, directory := range []string{backend.UserWarehouse.Directory, backend.UserWarehouse.Temp} {
+		if stat, err := os.Stat(directory); err != nil || !stat.IsDir() {
+			return false
+		}
+	}
+
+	return true
+}
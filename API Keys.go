@@ -0,0 +1,249 @@
+/*
+File Name:  API Keys.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Multiple named API keys with scopes. The scope limits the API functions and console commands a key may use.
+Keys may be stored as SHA-256 hash instead of plaintext in the settings file.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/PeernetOfficial/core/webapi"
+	"github.com/google/uuid"
+)
+
+func init() {
+	registerCommand(&command{Name: "api key hash", Args: []commandArgument{{Name: "key", Prompt: "Enter the API key (UUID) to hash:", Sensitive: true}}, Help: "Create the hash of an API key for the APIKeys setting", Handler: cmdAPIKeyHash})
+}
+
+// Scopes of API keys. Each scope includes the permissions of the lower scopes.
+const (
+	apiScopeStatus    = iota // Read-only status: health, readiness, metrics, status and peer information.
+	apiScopeTransfers        // Status and transfers.
+	apiScopeConsole          // Console via /console, except commands that require the admin scope such as key and exit commands.
+	apiScopeAdmin            // Full access to all API functions and commands.
+)
+
+var apiScopeNames = map[string]int{"status": apiScopeStatus, "transfers": apiScopeTransfers, "console": apiScopeConsole, "admin": apiScopeAdmin}
+
+// apiPathScopes is the minimum scope for each API path. All other paths including the functions provided by core require the admin scope.
+var apiPathScopes = map[string]int{
+	"/test":                 apiScopeStatus,
+	"/status":               apiScopeStatus,
+	"/status/peers":         apiScopeStatus,
+	"/health":               apiScopeStatus,
+	"/ready":                apiScopeStatus,
+	"/metrics":              apiScopeStatus,
+	"/cmd/status":           apiScopeStatus,
+	"/cmd/peer/connections": apiScopeStatus,
+	"/cmd/transfers":        apiScopeTransfers,
+	"/download/status":      apiScopeTransfers,
+	"/console":              apiScopeConsole,
+}
+
+// apiKeyConfig is an API key in the settings file. Either the plaintext key or the hash must be set.
+type apiKeyConfig struct {
+	Name  string `yaml:"Name"`  // Name of the key. It is used in log messages.
+	Key   string `yaml:"Key"`   // API key (UUID) in plaintext.
+	Hash  string `yaml:"Hash"`  // Hex-encoded SHA-256 hash of the API key instead of the plaintext key. It can be created with the "api key hash" command.
+	Scope string `yaml:"Scope"` // Scope of the key: status, transfers, console, admin.
+}
+
+// apiCaller identifies the API key used for a request.
+type apiCaller struct {
+	Name  string // Name of the API key.
+	Scope int    // Scope of the API key.
+}
+
+// apiKey is a loaded API key.
+type apiKey struct {
+	apiCaller
+	hash []byte // SHA-256 hash of the key.
+}
+
+type apiCallerContextKey struct{}
+
+// apiKeyHash returns the SHA-256 hash of the API key.
+func apiKeyHash(key uuid.UUID) []byte {
+	hash := sha256.Sum256([]byte(key.String()))
+	return hash[:]
+}
+
+// apiKeysLoad returns the API keys from the APIKeys setting. A single key provided via the APIKey setting or the -apikey parameter is added with the admin scope.
+func apiKeysLoad(single uuid.UUID, configured []apiKeyConfig) (keys []apiKey, err error) {
+	if single != uuid.Nil {
+		keys = append(keys, apiKey{apiCaller: apiCaller{Name: "APIKey", Scope: apiScopeAdmin}, hash: apiKeyHash(single)})
+	}
+
+	for n, entry := range configured {
+		key := apiKey{apiCaller: apiCaller{Name: entry.Name}}
+
+		if key.Name == "" {
+			return nil, fmt.Errorf("API key %d: missing name", n+1)
+		}
+
+		var ok bool
+		if key.Scope, ok = apiScopeNames[strings.ToLower(entry.Scope)]; !ok {
+			return nil, fmt.Errorf("API key '%s': invalid scope '%s'", entry.Name, entry.Scope)
+		}
+
+		switch {
+		case entry.Key != "" && entry.Hash != "":
+			return nil, fmt.Errorf("API key '%s': only one of Key or Hash may be set", entry.Name)
+		case entry.Key != "":
+			plain, err := uuid.Parse(entry.Key)
+			if err != nil {
+				return nil, fmt.Errorf("API key '%s': invalid key: %w", entry.Name, err)
+			}
+			key.hash = apiKeyHash(plain)
+		default:
+			if key.hash, err = hex.DecodeString(entry.Hash); err != nil || len(key.hash) != sha256.Size {
+				return nil, fmt.Errorf("API key '%s': invalid hash, must be a hex-encoded SHA-256 hash", entry.Name)
+			}
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// apiAuthenticate returns a middleware that checks the API key of each request and whether its scope permits the path.
+// Remote addresses that are blocked by the guard after failed attempts are refused with 429 without checking the key.
+// It replaces the single key authentication of core. The API key is read from the x-api-key header, or from the k parameter for paths that allow it.
+// If RefuseKeyInParam is set, keys in the k parameter are refused except for the named keys in KeyInParamClients.
+// If SocketNoKey is set, requests via Unix domain sockets do not require an API key and have the admin scope.
+func apiAuthenticate(api *webapi.WebapiInstance, keys []apiKey, settings *apiSettings, guard *apiAuthGuard) func(http.Handler) http.Handler {
+	socketCaller := apiCaller{Name: "unix socket", Scope: apiScopeAdmin}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if settings.SocketNoKey && apiViaSocket(r.Context()) {
+				if source := auditSourceFromContext(r.Context()); source != nil {
+					source.Key = socketCaller.Name
+				}
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiCallerContextKey{}, socketCaller)))
+				return
+			}
+
+			remoteIP := apiRemoteIP(r)
+			if wait := guard.blocked(remoteIP); wait > 0 {
+				guard.refuse(w, wait)
+				return
+			}
+
+			keyInParam := false
+			keyID, err := uuid.Parse(r.Header.Get("x-api-key"))
+			if err != nil { // special case for some paths
+				for _, exceptPath := range api.AllowKeyInParam {
+					if exceptPath == r.URL.Path {
+						r.ParseForm()
+						keyID, err = uuid.Parse(r.Form.Get("k"))
+						keyInParam = true
+						break
+					}
+				}
+			}
+			if err != nil { // Invalid key format. Only counted as failure if a key was provided.
+				if r.Header.Get("x-api-key") != "" || keyInParam && r.Form.Get("k") != "" {
+					guard.failure(remoteIP)
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			hash := apiKeyHash(keyID)
+			var caller *apiCaller
+			for n := range keys {
+				if subtle.ConstantTimeCompare(keys[n].hash, hash) == 1 {
+					caller = &keys[n].apiCaller
+					break
+				}
+			}
+
+			if source := auditSourceFromContext(r.Context()); source != nil && caller != nil {
+				source.Key = caller.Name
+			}
+
+			if caller == nil {
+				guard.failure(remoteIP)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			guard.success(remoteIP)
+
+			if keyInParam && settings.RefuseKeyInParam && !apiKeyInParamAllowed(caller.Name, settings.KeyInParamClients) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			} else if caller.Scope < apiPathScope(r.URL.Path) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiCallerContextKey{}, *caller)))
+		})
+	}
+}
+
+// apiKeyInParamAllowed checks if the named key is in the list of clients that may provide the key in the k parameter.
+func apiKeyInParamAllowed(name string, clients []string) bool {
+	for _, client := range clients {
+		if client == name {
+			return true
+		}
+	}
+	return false
+}
+
+// apiPathScope returns the minimum scope for the path.
+func apiPathScope(path string) int {
+	if scope, ok := apiPathScopes[path]; ok {
+		return scope
+	}
+	return apiScopeAdmin
+}
+
+// apiCallerFromContext returns the API key of the request or console session. If no API key was used, for example on the command line or if API keys are not used, ok is false.
+func apiCallerFromContext(ctx context.Context) (caller apiCaller, ok bool) {
+	caller, ok = ctx.Value(apiCallerContextKey{}).(apiCaller)
+	return caller, ok
+}
+
+// apiScopeFromContext returns the scope of the request or console session. Without an API key all permissions are granted.
+func apiScopeFromContext(ctx context.Context) int {
+	if caller, ok := apiCallerFromContext(ctx); ok {
+		return caller.Scope
+	}
+	return apiScopeAdmin
+}
+
+func cmdAPIKeyHash(session *commandSession) {
+	text, _, terminate := session.argString(0)
+	if terminate {
+		return
+	}
+
+	key, err := uuid.Parse(text)
+	if err != nil {
+		session.errorf("Invalid API key. A UUID is required.\n")
+		return
+	}
+
+	hash := hex.EncodeToString(apiKeyHash(key))
+	if session.output.JSON {
+		session.output.writeJSON(jsonHash{Hash: hash})
+		return
+	}
+	fmt.Fprintf(session.output, "SHA-256 hash: %s\n", hash)
+}
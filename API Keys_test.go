@@ -0,0 +1,171 @@
+/*
+File Name:  API Keys_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Tests of the scopes of API keys, keys in URL parameters and keyless access via Unix domain sockets.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/PeernetOfficial/core/webapi"
+	"github.com/google/uuid"
+)
+
+// testAPIKeys are one key per scope. The status key is configured as hash.
+var testAPIKeys = map[string]uuid.UUID{
+	"status":    uuid.MustParse("00000000-0000-4000-8000-000000000001"),
+	"transfers": uuid.MustParse("00000000-0000-4000-8000-000000000002"),
+	"console":   uuid.MustParse("00000000-0000-4000-8000-000000000003"),
+	"admin":     uuid.MustParse("00000000-0000-4000-8000-000000000004"),
+}
+
+// testAPIAuthenticate sends the request through apiAuthenticate with one key per scope. It returns the status code and the caller seen by the handler.
+func testAPIAuthenticate(t *testing.T, settings *apiSettings, r *http.Request) (status int, caller apiCaller, ok bool) {
+	keys, err := apiKeysLoad(uuid.Nil, []apiKeyConfig{
+		{Name: "status", Hash: hex.EncodeToString(apiKeyHash(testAPIKeys["status"])), Scope: "status"},
+		{Name: "transfers", Key: testAPIKeys["transfers"].String(), Scope: "transfers"},
+		{Name: "console", Key: testAPIKeys["console"].String(), Scope: "console"},
+		{Name: "admin", Key: testAPIKeys["admin"].String(), Scope: "Admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := &webapi.WebapiInstance{AllowKeyInParam: []string{"/console", "/health"}}
+
+	// A new guard for each request, so that failures of previous requests do not block.
+	handler := apiAuthenticate(api, keys, settings, newAPIAuthGuard(nil, 0, 0, 0))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, ok = apiCallerFromContext(r.Context())
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+
+	return recorder.Code, caller, ok
+}
+
+// TestAPIScopes checks for each scope which paths are allowed.
+func TestAPIScopes(t *testing.T) {
+	scopes := []string{"status", "transfers", "console", "admin"}
+
+	tests := []struct {
+		path  string
+		scope string // Minimum scope.
+	}{
+		{"/test", "status"},
+		{"/status", "status"},
+		{"/status/peers", "status"},
+		{"/health", "status"},
+		{"/ready", "status"},
+		{"/metrics", "status"},
+		{"/cmd/status", "status"},
+		{"/cmd/peer/connections", "status"},
+		{"/cmd/transfers", "transfers"},
+		{"/download/status", "transfers"},
+		{"/console", "console"},
+		{"/shutdown", "admin"},
+		{"/audit", "admin"},
+		{"/download/start", "admin"},
+		{"/blockchain/add", "admin"},
+		{"/account/delete", "admin"},
+		{"/cmd/unknown", "admin"},
+		{"/", "admin"},
+	}
+
+	for _, test := range tests {
+		for _, scope := range scopes {
+			r := httptest.NewRequest("GET", test.path, nil)
+			r.Header.Set("x-api-key", testAPIKeys[scope].String())
+
+			want := http.StatusForbidden
+			if apiScopeNames[scope] >= apiScopeNames[test.scope] {
+				want = http.StatusOK
+			}
+
+			status, caller, _ := testAPIAuthenticate(t, &apiSettings{}, r)
+			if status != want {
+				t.Errorf("%s with scope %s: got status %d, want %d", test.path, scope, status, want)
+			} else if status == http.StatusOK && caller.Name != scope {
+				t.Errorf("%s with scope %s: got caller %s", test.path, scope, caller.Name)
+			}
+		}
+	}
+
+	// missing and invalid keys
+	for _, key := range []string{"", "invalid", uuid.New().String()} {
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.Header.Set("x-api-key", key)
+		if status, _, _ := testAPIAuthenticate(t, &apiSettings{}, r); status != http.StatusUnauthorized {
+			t.Errorf("key '%s': got status %d, want 401", key, status)
+		}
+	}
+}
+
+// TestAPIKeyInParam checks keys provided in the k parameter, and their refusal via RefuseKeyInParam.
+func TestAPIKeyInParam(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings apiSettings
+		path     string
+		key      string
+		want     int
+	}{
+		{name: "allowed path", path: "/console", key: "console", want: http.StatusOK},
+		{name: "path without key in parameter", path: "/status", key: "admin", want: http.StatusUnauthorized},
+		{name: "scope is checked", path: "/console", key: "status", want: http.StatusForbidden},
+		{name: "refused", settings: apiSettings{RefuseKeyInParam: true}, path: "/console", key: "console", want: http.StatusUnauthorized},
+		{name: "refused admin", settings: apiSettings{RefuseKeyInParam: true}, path: "/health", key: "admin", want: http.StatusUnauthorized},
+		{name: "refused other client", settings: apiSettings{RefuseKeyInParam: true, KeyInParamClients: []string{"admin"}}, path: "/console", key: "console", want: http.StatusUnauthorized},
+		{name: "allowed client", settings: apiSettings{RefuseKeyInParam: true, KeyInParamClients: []string{"console"}}, path: "/console", key: "console", want: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path+"?k="+testAPIKeys[test.key].String(), nil)
+		if status, _, _ := testAPIAuthenticate(t, &test.settings, r); status != test.want {
+			t.Errorf("%s: got status %d, want %d", test.name, status, test.want)
+		}
+
+		// The header is never refused.
+		r = httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("x-api-key", testAPIKeys[test.key].String())
+		if status, _, _ := testAPIAuthenticate(t, &test.settings, r); status == http.StatusUnauthorized {
+			t.Errorf("%s: key in header refused", test.name)
+		}
+	}
+}
+
+// TestAPISocketNoKey checks that requests via Unix domain sockets only skip the API key if SocketNoKey is set.
+func TestAPISocketNoKey(t *testing.T) {
+	socketRequest := func(path string) *http.Request {
+		r := httptest.NewRequest("GET", path, nil)
+		return r.WithContext(apiSocketConnContext(r.Context(), nil))
+	}
+
+	status, caller, ok := testAPIAuthenticate(t, &apiSettings{SocketNoKey: true}, socketRequest("/shutdown"))
+	if status != http.StatusOK || !ok || caller.Scope != apiScopeAdmin || caller.Name != "unix socket" {
+		t.Fatalf("socket without key: got status %d, caller %+v", status, caller)
+	}
+
+	if status, _, _ = testAPIAuthenticate(t, &apiSettings{}, socketRequest("/status")); status != http.StatusUnauthorized {
+		t.Fatalf("socket without key and SocketNoKey not set: got status %d, want 401", status)
+	}
+
+	// TCP connections always require a key.
+	if status, _, _ = testAPIAuthenticate(t, &apiSettings{SocketNoKey: true}, httptest.NewRequest("GET", "/status", nil)); status != http.StatusUnauthorized {
+		t.Fatalf("TCP without key: got status %d, want 401", status)
+	}
+
+	// Without SocketNoKey the scope of the key applies to requests via the socket as well.
+	r := socketRequest("/shutdown")
+	r.Header.Set("x-api-key", testAPIKeys["status"].String())
+	if status, _, _ = testAPIAuthenticate(t, &apiSettings{}, r); status != http.StatusForbidden {
+		t.Fatalf("socket with status key: got status %d, want 403", status)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+File Name:  API Metrics.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Metrics in the Prometheus text exposition format via /metrics.
+See https://prometheus.io/docs/instrumenting/exposition_formats/ for the format.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// metricSearchStatus counts the DHT search status events by function as observed through filterSearchStatus.
+var metricSearchStatus = make(map[string]uint64)
+var metricSearchStatusMutex sync.Mutex
+
+// metricsCountSearchStatus counts a DHT search status event.
+func metricsCountSearchStatus(function string) {
+	metricSearchStatusMutex.Lock()
+	metricSearchStatus[function]++
+	metricSearchStatusMutex.Unlock()
+}
+
+/*
+apiMetrics returns metrics in the Prometheus text exposition format.
+
+Request:    GET /metrics
+Result:     200 with metrics in text format
+*/
+func apiMetrics(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var m metricsWriter
+
+		peers := backend.PeerlistGet()
+
+		// peer count by root/NAT/firewall
+		peerCounts := make(map[[3]bool]int)
+		for _, peer := range peers {
+			peerCounts[[3]bool{peer.IsRootPeer, peer.IsBehindNAT(), peer.IsFirewallReported()}]++
+		}
+		m.header("peernet_peers", "gauge", "Count of peers.")
+		for _, key := range sortedBoolKeys(peerCounts) {
+			m.sample("peernet_peers", []string{"root", strconv.FormatBool(key[0]), "nat", strconv.FormatBool(key[1]), "firewall", strconv.FormatBool(key[2])}, float64(peerCounts[key]))
+		}
+
+		// per-peer statistics
+		m.header("peernet_peer_packets_sent_total", "counter", "Count of packets sent to the peer.")
+		for _, peer := range peers {
+			m.sample("peernet_peer_packets_sent_total", []string{"node_id", hex.EncodeToString(peer.NodeID)}, float64(peer.StatsPacketSent))
+		}
+		m.header("peernet_peer_packets_received_total", "counter", "Count of packets received from the peer.")
+		for _, peer := range peers {
+			m.sample("peernet_peer_packets_received_total", []string{"node_id", hex.EncodeToString(peer.NodeID)}, float64(peer.StatsPacketReceived))
+		}
+		m.header("peernet_peer_rtt_seconds", "gauge", "Round-trip time to the peer. Only peers with known RTT are listed.")
+		for _, peer := range peers {
+			if rtt := peer.GetRTT(); rtt > 0 {
+				m.sample("peernet_peer_rtt_seconds", []string{"node_id", hex.EncodeToString(peer.NodeID)}, rtt.Seconds())
+			}
+		}
+
+		// active connections by adapter
+		connectionCounts := make(map[string]int)
+		for _, peer := range peers {
+			for _, c := range peer.GetConnections(true) {
+				connectionCounts[c.Network.GetAdapterName()]++
+			}
+		}
+		m.header("peernet_connections_active", "gauge", "Count of active connections to peers by network adapter.")
+		for _, adapter := range sortedStringKeys(connectionCounts) {
+			m.sample("peernet_connections_active", []string{"adapter", adapter}, float64(connectionCounts[adapter]))
+		}
+
+		// active transfers and aggregated UDT packet counters
+		transferCounts := make(map[string]int)
+		var udtTotal jsonUDTMetrics
+		for _, transfer := range transfersToJSON(backend) {
+			if transfer.Status == "active" {
+				transferCounts[transfer.Type+" "+transfer.Direction]++
+			}
+			if metrics := transfer.Metrics; metrics != nil {
+				udtTotal.HandshakeSent += metrics.HandshakeSent
+				udtTotal.HandshakeReceived += metrics.HandshakeReceived
+				udtTotal.ShutdownSent += metrics.ShutdownSent
+				udtTotal.ShutdownReceived += metrics.ShutdownReceived
+				udtTotal.ACKSent += metrics.ACKSent
+				udtTotal.ACKReceived += metrics.ACKReceived
+				udtTotal.NAKSent += metrics.NAKSent
+				udtTotal.NAKReceived += metrics.NAKReceived
+				udtTotal.ACK2Sent += metrics.ACK2Sent
+				udtTotal.ACK2Received += metrics.ACK2Received
+				udtTotal.DataPacketsSent += metrics.DataPacketsSent
+				udtTotal.DataPacketsReceived += metrics.DataPacketsReceived
+			}
+		}
+		m.header("peernet_transfers_active", "gauge", "Count of active file and block transfers.")
+		for _, key := range sortedStringKeys(transferCounts) {
+			typeDirection := strings.SplitN(key, " ", 2)
+			m.sample("peernet_transfers_active", []string{"type", typeDirection[0], "direction", typeDirection[1]}, float64(transferCounts[key]))
+		}
+
+		m.header("peernet_transfer_udt_packets", "gauge", "UDT packet counters aggregated over the current transfer sessions.")
+		for _, counter := range []struct {
+			packet, direction string
+			value             uint64
+		}{
+			{"handshake", "sent", udtTotal.HandshakeSent}, {"handshake", "received", udtTotal.HandshakeReceived},
+			{"shutdown", "sent", udtTotal.ShutdownSent}, {"shutdown", "received", udtTotal.ShutdownReceived},
+			{"ack", "sent", udtTotal.ACKSent}, {"ack", "received", udtTotal.ACKReceived},
+			{"nak", "sent", udtTotal.NAKSent}, {"nak", "received", udtTotal.NAKReceived},
+			{"ack2", "sent", udtTotal.ACK2Sent}, {"ack2", "received", udtTotal.ACK2Received},
+			{"data", "sent", udtTotal.DataPacketsSent}, {"data", "received", udtTotal.DataPacketsReceived},
+		} {
+			m.sample("peernet_transfer_udt_packets", []string{"packet", counter.packet, "direction", counter.direction}, float64(counter.value))
+		}
+
+		// DHT search status events
+		metricSearchStatusMutex.Lock()
+		searchCounts := make(map[string]int, len(metricSearchStatus))
+		for function, count := range metricSearchStatus {
+			searchCounts[function] = int(count)
+		}
+		metricSearchStatusMutex.Unlock()
+
+		m.header("peernet_dht_search_events_total", "counter", "Count of DHT search status events by function.")
+		for _, function := range sortedStringKeys(searchCounts) {
+			m.sample("peernet_dht_search_events_total", []string{"function", function}, float64(searchCounts[function]))
+		}
+
+		// API key authentication
+		m.header("peernet_api_auth_failures_total", "counter", "Count of failed API key authentication attempts.")
+		m.sample("peernet_api_auth_failures_total", nil, float64(atomic.LoadUint64(&metricAuthFailures)))
+		m.header("peernet_api_auth_lockouts_total", "counter", "Count of remote addresses locked out after too many failed API key authentication attempts.")
+		m.sample("peernet_api_auth_lockouts_total", nil, float64(atomic.LoadUint64(&metricAuthLockouts)))
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(m.String()))
+	}
+}
+
+// metricsWriter creates the text exposition format.
+type metricsWriter struct {
+	strings.Builder
+}
+
+// header writes the HELP and TYPE lines of a metric. All samples of the metric must follow.
+func (m *metricsWriter) header(name, metricType, help string) {
+	m.WriteString("# HELP " + name + " " + help + "\n")
+	m.WriteString("# TYPE " + name + " " + metricType + "\n")
+}
+
+// sample writes a single sample. Labels are provided as name and value pairs.
+func (m *metricsWriter) sample(name string, labels []string, value float64) {
+	m.WriteString(name)
+
+	if len(labels) > 0 {
+		m.WriteString("{")
+		for n := 0; n+1 < len(labels); n += 2 {
+			if n > 0 {
+				m.WriteString(",")
+			}
+			m.WriteString(labels[n] + "=\"" + metricsEscapeLabel(labels[n+1]) + "\"")
+		}
+		m.WriteString("}")
+	}
+
+	m.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// metricsEscapeLabel escapes backslash, double-quote, and line feed in label values.
+func metricsEscapeLabel(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
+
+func sortedStringKeys(m map[string]int) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedBoolKeys(m map[[3]bool]int) (keys [][3]bool) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		for n := range keys[i] {
+			if keys[i][n] != keys[j][n] {
+				return !keys[i][n]
+			}
+		}
+		return false
+	})
+	return keys
+}
@@ -0,0 +1,107 @@
+/*
+File Name:  API Origin.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Origin check for /console and the endpoints of this application. Browsers send the Origin header with cross-origin requests and websocket upgrades.
+Requests from origins other than the API itself are refused unless the origin is in the allowlist. Requests without Origin header are not from browsers and are allowed.
+Same-origin requests are only accepted if the Host header is a loopback name or a listen address of the API. Otherwise a web page could use DNS rebinding to resolve its
+own domain to the API and pass as same origin. Browsers do not send the Origin header with same-origin GET requests, therefore the Sec-Fetch-Site header is checked as well.
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// apiOriginChecker returns a function that checks whether the origin of the request is allowed.
+// Allowed origins are in the format scheme://host[:port], for example "http://localhost:3000". The entry "*" allows all origins.
+// Listen are the listen addresses of the API. Same-origin requests are only allowed if the Host header matches one of them or a loopback name.
+func apiOriginChecker(allowedOrigins, listen []string) func(r *http.Request) bool {
+	allowed := make(map[string]bool)
+	for _, origin := range allowedOrigins {
+		allowed[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		fetchSite := r.Header.Get("Sec-Fetch-Site")
+
+		// Browsers cannot connect to Unix domain sockets. Requests without Origin header that are not sent by a web page are not from browsers or initiated by the user.
+		if apiViaSocket(r.Context()) || origin == "" && (fetchSite == "" || fetchSite == "none") {
+			return true
+		} else if origin != "" && (allowed["*"] || allowed[strings.ToLower(origin)]) {
+			return true
+		} else if !apiHostAllowed(r.Host, listen) {
+			return false
+		} else if origin == "" {
+			return true
+		}
+
+		// same-origin requests
+		originURL, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(originURL.Host, r.Host)
+	}
+}
+
+// apiHostAllowed checks if the host from the Host header is a loopback name or a listen address. The host is in the format host[:port].
+// If a listen address does not specify an IP, any IP address with the same port is accepted. Other domain names are only accepted if used in a listen address, because they could be rebound.
+func apiHostAllowed(host string, listen []string) bool {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, port = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ""
+	}
+
+	ip := net.ParseIP(hostname)
+	if strings.EqualFold(hostname, "localhost") || ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	for _, address := range listen {
+		if _, ok := apiSocketPath(address); ok {
+			continue
+		}
+
+		listenHost, listenPort, err := net.SplitHostPort(address)
+		if err != nil || port != "" && port != listenPort {
+			continue
+		}
+
+		if listenIP := net.ParseIP(listenHost); listenHost == "" || listenIP != nil && listenIP.IsUnspecified() {
+			if ip != nil {
+				return true
+			}
+		} else if listenIP != nil && ip != nil && listenIP.Equal(ip) || listenIP == nil && strings.EqualFold(listenHost, hostname) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apiOrigin wraps the handler and refuses requests from origins that are not allowed with 403.
+func apiOrigin(checkOrigin func(r *http.Request) bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkOrigin(r) {
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// consoleUpgrader returns the websocket upgrader for /console. Unlike webapi.WSUpgrader it refuses upgrades from origins that are not allowed.
+func consoleUpgrader(checkOrigin func(r *http.Request) bool) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     checkOrigin,
+	}
+}
@@ -0,0 +1,69 @@
+/*
+File Name:  API Origin_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Tests of the origin check, including DNS rebinding.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIOriginChecker(t *testing.T) {
+	listen := []string{"127.0.0.1:112", "192.168.1.5:113", "0.0.0.0:114", "unix:/run/peernet.sock"}
+
+	tests := []struct {
+		name      string
+		allowed   []string
+		host      string
+		origin    string
+		fetchSite string
+		socket    bool
+		want      bool
+	}{
+		{name: "no origin", host: "evil.example.com:112", want: true},
+		{name: "no origin user navigation", host: "evil.example.com:112", fetchSite: "none", want: true},
+		{name: "same origin localhost", host: "localhost:112", origin: "http://localhost:112", want: true},
+		{name: "same origin 127.0.0.1", host: "127.0.0.1:112", origin: "http://127.0.0.1:112", want: true},
+		{name: "same origin ::1", host: "[::1]:112", origin: "http://[::1]:112", want: true},
+		{name: "same origin listen address", host: "192.168.1.5:113", origin: "https://192.168.1.5:113", want: true},
+		{name: "same origin listen address other port", host: "192.168.1.5:112", origin: "http://192.168.1.5:112", want: false},
+		{name: "same origin unspecified listen address", host: "10.0.0.7:114", origin: "http://10.0.0.7:114", want: true},
+		{name: "cross origin", host: "localhost:112", origin: "http://evil.example.com", want: false},
+		{name: "rebinding", host: "evil.example.com:112", origin: "http://evil.example.com:112", want: false},
+		{name: "rebinding unspecified listen address", host: "evil.example.com:114", origin: "http://evil.example.com:114", want: false},
+		{name: "rebinding without origin", host: "evil.example.com:112", fetchSite: "same-origin", want: false},
+		{name: "same site without origin", host: "localhost:112", fetchSite: "same-origin", want: true},
+		{name: "allowlist", allowed: []string{"http://localhost:3000/"}, host: "localhost:112", origin: "http://localhost:3000", want: true},
+		{name: "allowlist case", allowed: []string{"http://LOCALHOST:3000"}, host: "localhost:112", origin: "http://localhost:3000", want: true},
+		{name: "allowlist other origin", allowed: []string{"http://localhost:3000"}, host: "localhost:112", origin: "http://localhost:3001", want: false},
+		{name: "allow all", allowed: []string{"*"}, host: "localhost:112", origin: "http://evil.example.com", want: true},
+		{name: "allow all rebinding", allowed: []string{"*"}, host: "evil.example.com:112", origin: "http://evil.example.com:112", want: true},
+		{name: "socket", host: "evil.example.com", origin: "http://evil.example.com", socket: true, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/console", nil)
+			r.Host = test.host
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+			if test.fetchSite != "" {
+				r.Header.Set("Sec-Fetch-Site", test.fetchSite)
+			}
+			if test.socket {
+				r = r.WithContext(apiSocketConnContext(context.Background(), nil))
+			}
+
+			if got := apiOriginChecker(test.allowed, listen)(r); got != test.want {
+				t.Errorf("got %t, want %t", got, test.want)
+			}
+		})
+	}
+}
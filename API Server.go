@@ -0,0 +1,137 @@
+/*
+File Name:  API Server.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+HTTP servers of the API. The core webapi package starts its own servers which cannot be stopped. Instead, this application only uses the
+router created by core and runs its own servers, so they can be shut down gracefully.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// apiListenNone is passed as listen address to webapi.Start. It is invalid on purpose so that the listener started by core fails immediately. See apiCoreInstance.
+const apiListenNone = "none"
+
+// errAPIServe indicates that the API settings are valid, but the API could not be started on all listen addresses.
+var errAPIServe = errors.New("error starting API")
+
+// apiServer is a running API server and its listener.
+type apiServer struct {
+	*http.Server
+	listener net.Listener
+}
+
+var apiServers []apiServer
+var apiServersMutex sync.Mutex
+
+// apiServe starts an HTTP server for each listen address of the settings. Addresses that fail to listen are logged and skipped.
+// Listen addresses are either IP:Port or unix:/path for Unix domain sockets.
+// The certificate file and key are only used if SSL is enabled. If they do not exist, a self-signed certificate is created. The read and write timeout may be 0 for no timeout.
+// An error wrapping errAPIServe is returned if the certificate cannot be loaded or if any address fails to listen.
+func apiServe(backend *core.Backend, handler http.Handler, settings *apiSettings) (err error) {
+	apiServersMutex.Lock()
+	defer apiServersMutex.Unlock()
+
+	var certificate *apiCertificate
+	if settings.UseSSL {
+		if certificate, err = apiCertificateLoad(backend, settings.Listen, settings.CertificateFile, settings.CertificateKey); err != nil {
+			backend.LogError("apiServe", "error loading API certificate '%s': %v\n", settings.CertificateFile, err)
+			return fmt.Errorf("%w: loading certificate '%s': %v", errAPIServe, settings.CertificateFile, err)
+		}
+	}
+
+	for _, listen := range settings.Listen {
+		server := &http.Server{
+			Addr:         listen,
+			Handler:      handler,
+			ReadTimeout:  settings.TimeoutRead,
+			WriteTimeout: settings.TimeoutWrite,
+			TLSConfig:    &tls.Config{MinVersion: tls.VersionTLS12}, // for security reasons disable TLS 1.0/1.1
+		}
+		if certificate != nil {
+			server.TLSConfig.GetCertificate = certificate.getCertificate
+		}
+
+		var listener net.Listener
+		var errListen error
+		if path, ok := apiSocketPath(listen); ok {
+			listener, errListen = apiSocketListen(path, settings.SocketMode, settings.SocketOwner)
+			server.ConnContext = apiSocketConnContext
+		} else {
+			listener, errListen = net.Listen("tcp", listen)
+		}
+		if errListen != nil {
+			backend.LogError("apiServe", "error listening on '%s': %v\n", listen, errListen)
+			if err == nil {
+				err = fmt.Errorf("%w: listening on '%s': %v", errAPIServe, listen, errListen)
+			}
+			continue
+		}
+
+		backend.LogError("apiServe", "start API at '%s'\n", listen)
+
+		go func() {
+			var err error
+			if certificate != nil {
+				err = server.ServeTLS(listener, "", "")
+			} else {
+				err = server.Serve(listener)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				backend.LogError("apiServe", "error serving API at '%s': %v\n", server.Addr, err)
+			}
+		}()
+
+		apiServers = append(apiServers, apiServer{Server: server, listener: listener})
+	}
+
+	return err
+}
+
+// apiStop stops all API servers. New connections are refused immediately and active requests may complete until the context expires.
+// It returns the count of servers that had to be closed forcefully because active requests did not complete in time.
+func apiStop(ctx context.Context) (interrupted int) {
+	apiServersMutex.Lock()
+	servers := apiServers
+	apiServers = nil
+	apiServersMutex.Unlock()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server apiServer) {
+			defer wg.Done()
+
+			err := server.Shutdown(ctx)
+
+			// Shutdown only closes the listener if the server already started serving. Otherwise the listener would remain open until the Go routine of the server runs.
+			server.listener.Close()
+
+			if err != nil {
+				server.Close()
+
+				mutex.Lock()
+				interrupted++
+				mutex.Unlock()
+			}
+		}(server)
+	}
+
+	wg.Wait()
+
+	return interrupted
+}
@@ -0,0 +1,150 @@
+/*
+File Name:  API Socket.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Unix domain socket listeners for the API via listen addresses in the format unix:/path/to/socket.
+Access to the socket is protected by its file permissions. Optionally requests via the socket do not require an API key.
+The socket is created in a temporary directory that only the current user can access. It is moved to its path after the mode and owner are applied,
+so that it is never accessible with the default permissions of the process.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// apiListenUnix is the prefix of listen addresses for Unix domain sockets.
+const apiListenUnix = "unix:"
+
+// apiSocketModeDefault is the default file mode of sockets. Only the owner may connect.
+const apiSocketModeDefault os.FileMode = 0600
+
+type apiSocketContextKey struct{}
+
+// apiSocketPath returns the path of the socket if the listen address is a Unix domain socket.
+func apiSocketPath(listen string) (path string, ok bool) {
+	if !strings.HasPrefix(listen, apiListenUnix) {
+		return "", false
+	}
+	return strings.TrimPrefix(listen, apiListenUnix), true
+}
+
+// parseSocketMode parses the file mode of sockets in octal format, for example "0660". Empty returns the default mode.
+func parseSocketMode(input string) (mode os.FileMode, err error) {
+	if input == "" {
+		return apiSocketModeDefault, nil
+	}
+
+	value, err := strconv.ParseUint(input, 8, 32)
+	if err != nil || value > 0777 {
+		return 0, fmt.Errorf("invalid socket mode '%s': must be octal permissions such as 0660", input)
+	}
+	return os.FileMode(value), nil
+}
+
+// apiSocketListen listens on the Unix domain socket. A socket file remaining from a previous run is removed.
+// The mode and owner are applied to the socket file. The owner is in the format user[:group] and may be empty to not change it.
+// The socket is created in a temporary directory with mode 0700 next to the path and moved to the path once the mode and owner are applied.
+func apiSocketListen(path string, mode os.FileMode, owner string) (listener net.Listener, err error) {
+	if stat, err := os.Lstat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	directory, err := os.MkdirTemp(filepath.Dir(path), ".s")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(directory)
+
+	temporary := filepath.Join(directory, filepath.Base(path))
+	if listener, err = net.Listen("unix", temporary); err != nil {
+		return nil, err
+	}
+
+	// The socket file is removed by apiSocketListener after it is moved.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err = os.Chmod(temporary, mode); err == nil && owner != "" {
+		err = apiSocketChown(temporary, owner)
+	}
+	if err == nil {
+		// Other files at the path are never replaced.
+		if _, errStat := os.Lstat(path); errStat == nil {
+			err = fmt.Errorf("file '%s' already exists and is not a socket", path)
+		} else {
+			err = os.Rename(temporary, path)
+		}
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &apiSocketListener{Listener: listener, path: path}, nil
+}
+
+// apiSocketListener removes the socket file when it is closed.
+type apiSocketListener struct {
+	net.Listener
+	path string
+	once sync.Once
+}
+
+func (listener *apiSocketListener) Close() (err error) {
+	err = listener.Listener.Close()
+	listener.once.Do(func() { os.Remove(listener.path) })
+	return err
+}
+
+// apiSocketChown changes the owner of the socket file. Users and groups may be specified by name or ID.
+func apiSocketChown(path, owner string) (err error) {
+	userName, groupName, _ := strings.Cut(owner, ":")
+	uid, gid := -1, -1
+
+	if userName != "" {
+		account, err := user.Lookup(userName)
+		if err != nil {
+			if account, err = user.LookupId(userName); err != nil {
+				return err
+			}
+		}
+		if uid, err = strconv.Atoi(account.Uid); err != nil {
+			return err
+		}
+	}
+
+	if groupName != "" {
+		group, err := user.LookupGroup(groupName)
+		if err != nil {
+			if group, err = user.LookupGroupId(groupName); err != nil {
+				return err
+			}
+		}
+		if gid, err = strconv.Atoi(group.Gid); err != nil {
+			return err
+		}
+	}
+
+	return os.Chown(path, uid, gid)
+}
+
+// apiSocketConnContext marks connections via Unix domain sockets in the request context.
+func apiSocketConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, apiSocketContextKey{}, true)
+}
+
+// apiViaSocket checks if the request was received via a Unix domain socket.
+func apiViaSocket(ctx context.Context) bool {
+	viaSocket, _ := ctx.Value(apiSocketContextKey{}).(bool)
+	return viaSocket
+}
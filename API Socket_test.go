@@ -0,0 +1,109 @@
+/*
+File Name:  API Socket_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Tests of the Unix domain socket listeners.
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+// TestAPISocketListen checks the mode of the socket file, that no temporary files remain, and that the socket file is removed when closed.
+func TestAPISocketListen(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes of sockets are not supported on Windows")
+	}
+
+	tests := []struct {
+		mode  os.FileMode
+		owner string
+	}{
+		{mode: 0600},
+		{mode: 0660},
+		{mode: 0666},
+		{mode: 0600, owner: strconv.Itoa(os.Getuid())},
+		{mode: 0640, owner: strconv.Itoa(os.Getuid()) + ":" + strconv.Itoa(os.Getgid())},
+	}
+
+	for _, test := range tests {
+		directory := t.TempDir()
+		path := filepath.Join(directory, "api.sock")
+
+		listener, err := apiSocketListen(path, test.mode, test.owner)
+		if err != nil {
+			t.Fatalf("mode %o: error listening: %v", test.mode, err)
+		}
+
+		stat, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("mode %o: socket file missing: %v", test.mode, err)
+		} else if stat.Mode()&os.ModeSocket == 0 {
+			t.Fatalf("mode %o: file is not a socket", test.mode)
+		} else if stat.Mode().Perm() != test.mode {
+			t.Fatalf("got mode %o, want %o", stat.Mode().Perm(), test.mode)
+		}
+
+		if entries, _ := os.ReadDir(directory); len(entries) != 1 {
+			t.Fatalf("mode %o: temporary files remain: %d entries", test.mode, len(entries))
+		}
+
+		go func() {
+			if c, err := listener.Accept(); err == nil {
+				c.Close()
+			}
+		}()
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("mode %o: error connecting: %v", test.mode, err)
+		}
+		c.Close()
+
+		listener.Close()
+		listener.Close()
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Fatalf("mode %o: socket file not removed after close", test.mode)
+		}
+	}
+}
+
+// TestAPISocketListenStale checks that a socket file remaining from a previous run is replaced, while other files are not removed.
+func TestAPISocketListenStale(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes of sockets are not supported on Windows")
+	}
+
+	path := filepath.Join(t.TempDir(), "api.sock")
+
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := apiSocketListen(path, 0600, "")
+	if err != nil {
+		t.Fatalf("error replacing stale socket: %v", err)
+	}
+	listener.Close()
+
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if listener, err = apiSocketListen(path, 0600, ""); err == nil {
+		listener.Close()
+		t.Fatal("regular file was replaced by the socket")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Fatal("regular file was modified")
+	}
+}
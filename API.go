@@ -7,125 +7,343 @@ Author:     Peter Kleissner
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/PeernetOfficial/core"
 	"github.com/PeernetOfficial/core/webapi"
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
 // startAPI starts the API if enabled via command line parameter or if the settings are set in the config file.
-// Using the command line option always ignores any API settings from the config (including timeout settings).
-func startAPI(backend *core.Backend, apiListen []string, apiKey uuid.UUID) {
-	var api *webapi.WebapiInstance
-
-	if len(apiListen) > 0 {
-		// API listen parameter via command line argument.
-		// Note that read and write timeouts are set to 0 which means they are not used. SSL is not enabled.
-		api = webapi.Start(backend, apiListen, false, "", "", 0, 0, apiKey)
-
-	} else if len(config.APIListen) != 0 {
-		// API settings via config file.
-		api = webapi.Start(backend, config.APIListen, config.APIUseSSL, config.APICertificateFile, config.APICertificateKey, parseDuration(config.APITimeoutRead), parseDuration(config.APITimeoutWrite), config.APIKey)
-	} else {
-		return
+// Each API setting provided via command line overrides the matching setting from the config file.
+// An error is returned if a setting is invalid, in which case the API is not started. If the API could not be started on all listen addresses, an error wrapping errAPIServe is returned.
+func startAPI(backend *core.Backend, params *cmdParams) (err error) {
+	settings, err := params.apiSettings(&config)
+	if err != nil {
+		return err
+	} else if len(settings.Listen) == 0 {
+		return nil
 	}
 
-	api.InitGeoIPDatabase(backend.Config.GeoIPDatabase)
+	keys, err := apiKeysLoad(settings.Key, settings.Keys)
+	if err != nil {
+		return err
+	}
 
-	api.AllowKeyInParam = append(api.AllowKeyInParam, "/console")
-	api.Router.HandleFunc("/console", apiConsole(backend)).Methods("GET")
-	api.Router.HandleFunc("/shutdown", apiShutdown(backend)).Methods("GET")
+	api := apiCoreInstance(backend)
 
-	if config.DebugAPI {
-		attachDebugAPI(api)
+	// Each start uses a new router in front of the core router, so that the middlewares and functions of this application use the current settings.
+	// The API keys are checked by apiAuthenticate instead of core, which only supports a single key. Failed attempts are limited per remote address.
+	router := mux.NewRouter()
+	router.Use(auditMiddleware(backend))
+	if len(keys) > 0 {
+		router.Use(apiAuthenticate(api, keys, &settings, apiAuthGuardInstance(backend, settings.AuthMaxFailures, settings.AuthBackoff, settings.AuthLockout)))
 	}
+
+	// Browsers may only access the endpoints of this application from allowed origins.
+	checkOrigin := apiOriginChecker(settings.AllowedOrigins, settings.Listen)
+
+	router.HandleFunc("/console", apiConsole(backend, checkOrigin)).Methods("GET")
+	router.HandleFunc("/shutdown", apiOrigin(checkOrigin, apiShutdown(backend, params))).Methods("GET")
+	router.HandleFunc("/health", apiOrigin(checkOrigin, apiHealth(backend))).Methods("GET")
+	router.HandleFunc("/ready", apiOrigin(checkOrigin, apiReady(backend))).Methods("GET")
+	router.HandleFunc("/metrics", apiOrigin(checkOrigin, apiMetrics(backend))).Methods("GET")
+	router.HandleFunc("/cmd/status", apiOrigin(checkOrigin, apiCmdStatus(backend))).Methods("GET")
+	router.HandleFunc("/cmd/transfers", apiOrigin(checkOrigin, apiCmdTransfers(backend))).Methods("GET")
+	router.HandleFunc("/cmd/peer/connections", apiOrigin(checkOrigin, apiCmdPeerConnections(backend))).Methods("GET")
+	router.HandleFunc("/audit", apiOrigin(checkOrigin, apiAudit(backend))).Methods("GET")
+
+	// All other requests are handled by core. This route must be registered last.
+	router.PathPrefix("/").Handler(api.Router)
+
+	return apiServe(backend, router, &settings)
 }
 
-// parseCmdParams parses the "-webapi", "-apikey", and "-watchpid" command line parameters.
-// The API key is optional (for now) and set to 00000000-0000-0000-0000-000000000000 if none is provided.
+// apiCore is the API instance of the core library. It provides the API functions of core and is shared by all API starts.
+var apiCore *webapi.WebapiInstance
+var apiCoreOnce sync.Once
+
+// apiCoreInstance returns the API instance of the core library. It is created on first use.
+// The core library always starts its own listener, which cannot be stopped. Instead, apiListenNone is used so that it fails immediately, and the
+// router is served by apiServe. Creating the instance only once makes sure that this happens only once per process and not on every reload.
+func apiCoreInstance(backend *core.Backend) *webapi.WebapiInstance {
+	apiCoreOnce.Do(func() {
+		apiCore = webapi.Start(backend, []string{apiListenNone}, false, "", "", 0, 0, uuid.Nil)
+		apiCore.InitGeoIPDatabase(backend.Config.GeoIPDatabase)
+
+		apiCore.AllowKeyInParam = append(apiCore.AllowKeyInParam, "/console", "/health", "/ready", "/metrics")
+
+		// The debug setting is not reloaded.
+		if config.DebugAPI {
+			attachDebugAPI(apiCore)
+		}
+	})
+
+	return apiCore
+}
+
+// apiSettings contains the effective API settings.
+type apiSettings struct {
+	Listen          []string      // List of IP:Ports or unix:/path to listen. Empty if the API is not enabled.
+	UseSSL          bool          // Enables SSL.
+	CertificateFile string        // Certificate file, only used if SSL is enabled.
+	CertificateKey  string        // Private key file, only used if SSL is enabled.
+	TimeoutRead     time.Duration // Read timeout. 0 = not used.
+	TimeoutWrite    time.Duration // Write timeout. 0 = not used.
+
+	Key  uuid.UUID      // API key with admin scope. Empty UUID = not used.
+	Keys []apiKeyConfig // Named API keys with scopes.
+
+	AllowedOrigins    []string // Origins allowed to access /console and the endpoints of this application from a browser.
+	RefuseKeyInParam  bool     // Refuse API keys in the k parameter, except for the named keys in KeyInParamClients.
+	KeyInParamClients []string // Names of API keys that may provide the key in the k parameter if RefuseKeyInParam is set.
+
+	SocketMode  os.FileMode // File mode of Unix domain sockets.
+	SocketOwner string      // Owner of Unix domain sockets in the format user[:group]. Empty to not change.
+	SocketNoKey bool        // Requests via Unix domain sockets do not require an API key.
+
+	AuthMaxFailures int           // Count of failed attempts after which a remote address is locked out. 0 = default.
+	AuthBackoff     time.Duration // Wait time after the first failed attempt. 0 = default.
+	AuthLockout     time.Duration // Duration of the lockout. 0 = default.
+}
+
+// apiSettings returns the effective API settings from the config and the command line parameters. Parameters provided via command line override the matching settings from the config.
+func (params *cmdParams) apiSettings(fileConfig *cmdConfig) (settings apiSettings, err error) {
+	settings = apiSettings{
+		Listen:            fileConfig.APIListen,
+		UseSSL:            fileConfig.APIUseSSL,
+		CertificateFile:   fileConfig.APICertificateFile,
+		CertificateKey:    fileConfig.APICertificateKey,
+		Key:               fileConfig.APIKey,
+		Keys:              fileConfig.APIKeys,
+		AllowedOrigins:    fileConfig.APIAllowedOrigins,
+		RefuseKeyInParam:  fileConfig.APIRefuseKeyInParam,
+		KeyInParamClients: fileConfig.APIKeyInParamClients,
+		SocketOwner:       fileConfig.APISocketOwner,
+		SocketNoKey:       fileConfig.APISocketNoKey,
+		AuthMaxFailures:   fileConfig.APIAuthMaxFailures,
+	}
+
+	if settings.SocketMode, err = parseSocketMode(fileConfig.APISocketMode); err != nil {
+		return settings, err
+	}
+
+	if settings.TimeoutRead, err = parseDuration(fileConfig.APITimeoutRead); err != nil {
+		return settings, fmt.Errorf("invalid APITimeoutRead '%s': %w", fileConfig.APITimeoutRead, err)
+	}
+	if settings.TimeoutWrite, err = parseDuration(fileConfig.APITimeoutWrite); err != nil {
+		return settings, fmt.Errorf("invalid APITimeoutWrite '%s': %w", fileConfig.APITimeoutWrite, err)
+	}
+	if settings.AuthBackoff, err = parseDuration(fileConfig.APIAuthBackoff); err != nil {
+		return settings, fmt.Errorf("invalid APIAuthBackoff '%s': %w", fileConfig.APIAuthBackoff, err)
+	}
+	if settings.AuthLockout, err = parseDuration(fileConfig.APIAuthLockout); err != nil {
+		return settings, fmt.Errorf("invalid APIAuthLockout '%s': %w", fileConfig.APIAuthLockout, err)
+	}
+
+	for name := range params.APIFlags {
+		switch name {
+		case "webapi":
+			settings.Listen = params.APIListen
+		case "apikey":
+			settings.Key = params.APIKey
+		case "apissl":
+			settings.UseSSL = params.APIUseSSL
+		case "apicert":
+			settings.CertificateFile = params.APICertificateFile
+		case "apicertkey":
+			settings.CertificateKey = params.APICertificateKey
+		case "apitimeoutread":
+			settings.TimeoutRead = params.APITimeoutRead
+		case "apitimeoutwrite":
+			settings.TimeoutWrite = params.APITimeoutWrite
+		}
+	}
+
+	return settings, nil
+}
+
+// cmdParams contains the command line parameters.
+type cmdParams struct {
+	APIFlags           map[string]bool // Names of the API parameters provided via command line. Only those override the settings from the config.
+	APIListen          []string        // List of IP:Ports for the webapi to listen.
+	APIKey             uuid.UUID       // API key.
+	APIUseSSL          bool            // Enables SSL.
+	APICertificateFile string          // Certificate file for SSL.
+	APICertificateKey  string          // Private key file for SSL.
+	APITimeoutRead     time.Duration   // Read timeout of the API.
+	APITimeoutWrite    time.Duration   // Write timeout of the API.
+	WatchPID           int             // Process ID to monitor for exit. 0 if not provided.
+	Exec               string          // Command to execute non-interactively.
+	Script             string          // File containing commands to execute non-interactively.
+	WaitPeers          int             // Count of peers to wait for before executing the commands. 0 to not wait.
+	WaitTimeout        time.Duration   // Maximum duration to wait for peers.
+	OutputJSON         bool            // Output of commands via stdin, -exec, and -script is JSON instead of text.
+	Daemon             bool            // Daemon mode without the interactive command line.
+	PIDFile            string          // PID file to write in daemon mode. Empty for none.
+}
+
+// parseCmdParams parses the command line parameters.
+// The API parameters are optional and override the matching settings from the config file. Invalid timeouts are reported by the flag package.
 // The watch PID is set to 0 if not provided.
-func parseCmdParams() (apiListen []string, apiKey uuid.UUID, watchPID int) {
-	var paramWebapi, paramWebKeyA string
-	flag.StringVar(&paramWebapi, "webapi", "", "Specify the list of IP:Ports for the webapi to listen. Example: -webapi=127.0.0.1:1234")
+func parseCmdParams() (params cmdParams) {
+	var paramWebapi, paramWebKeyA, paramOutput string
+	flag.StringVar(&configFile, "config", configFile, "Config file to use. It is created if it does not exist.")
+	flag.StringVar(&configCmdFile, "cmdconfig", "", "Settings file of this application. Default is the config file name with extension .cmd.yaml, for example Config.cmd.yaml.")
+	flag.StringVar(&paramWebapi, "webapi", "", "Specify the list of IP:Ports or unix:/path for the webapi to listen. Example: -webapi=127.0.0.1:1234,unix:/run/peernet/api.sock")
 	flag.StringVar(&paramWebKeyA, "apikey", "", "Specify the API key to use. Must be a UUID.")
-	flag.IntVar(&watchPID, "watchpid", 0, "Monitor the specified process ID for exit to exit this application")
+	flag.BoolVar(&params.APIUseSSL, "apissl", false, "Enable SSL for the webapi. Requires -apicert and -apicertkey unless set in the config.")
+	flag.StringVar(&params.APICertificateFile, "apicert", "", "Certificate file for the webapi. This can also include the intermediate certificate from the CA.")
+	flag.StringVar(&params.APICertificateKey, "apicertkey", "", "Private key file of the certificate for the webapi")
+	flag.DurationVar(&params.APITimeoutRead, "apitimeoutread", 0, "Maximum duration for reading the entire request to the webapi, including the body. 0 for no timeout. Example: -apitimeoutread=10m")
+	flag.DurationVar(&params.APITimeoutWrite, "apitimeoutwrite", 0, "Maximum duration before timing out writes of the webapi response. 0 for no timeout. Example: -apitimeoutwrite=10m")
+	flag.IntVar(&params.WatchPID, "watchpid", 0, "Monitor the specified process ID for exit to exit this application")
+	flag.StringVar(&params.Exec, "exec", "", "Execute the command and exit. The exit code is nonzero if the command fails. Example: -exec=\"dht get [hash]\"")
+	flag.StringVar(&params.Script, "script", "", "Execute the commands from the file (one per line) and exit. The exit code is nonzero if any command fails.")
+	flag.IntVar(&params.WaitPeers, "waitpeers", 0, "Wait until connected to the specified count of peers before executing -exec or -script commands")
+	flag.DurationVar(&params.WaitTimeout, "waittimeout", time.Minute, "Maximum time to wait for peers specified via -waitpeers")
+	flag.StringVar(&paramOutput, "output", "text", "Output format of commands: text or json. In JSON mode each result is written as JSON document on a single line.")
+	flag.BoolVar(&params.Daemon, "daemon", false, "Run as daemon without the interactive command line. Output is only written to the log file. Readiness is reported via NOTIFY_SOCKET if set.")
+	flag.StringVar(&params.PIDFile, "pidfile", "Cmd.pid", "PID file to write in daemon mode. Empty to not write a PID file.")
 	flag.Parse()
 
-	if len(paramWebapi) == 0 {
-		return nil, apiKey, watchPID
+	switch strings.ToLower(paramOutput) {
+	case "json":
+		params.OutputJSON = true
+	case "text":
+	default:
+		// Written to stderr like the errors of the flag package.
+		fmt.Fprintf(os.Stderr, "Invalid output format '%s': must be text or json\n", paramOutput)
+		os.Exit(ExitParamOutputInvalid)
+	}
+
+	if configCmdFile == "" {
+		configCmdFile = configCmdFilename(configFile)
+	}
+
+	params.APIFlags = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "webapi", "apikey", "apissl", "apicert", "apicertkey", "apitimeoutread", "apitimeoutwrite":
+			params.APIFlags[f.Name] = true
+		}
+	})
+
+	if len(paramWebapi) != 0 {
+		params.APIListen = strings.Split(paramWebapi, ",")
 	}
 
 	if len(paramWebKeyA) != 0 {
 		var err error
-		if apiKey, err = uuid.Parse(paramWebKeyA); err != nil {
+		if params.APIKey, err = uuid.Parse(paramWebKeyA); err != nil {
 			os.Exit(core.ExitParamApiKeyInvalid)
 		}
 	}
 
-	return strings.Split(paramWebapi, ","), apiKey, watchPID
+	return params
 }
 
-// parseDuration is the same as time.ParseDuration without returning an error. Valid units are ms, s, m, h. For example "10s".
-func parseDuration(input string) (result time.Duration) {
-	result, _ = time.ParseDuration(input)
-	return
+// parseDuration is the same as time.ParseDuration, except that an empty input returns 0 which means not used. Valid units are ms, s, m, h. For example "10s".
+func parseDuration(input string) (result time.Duration, err error) {
+	if input == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(input)
 }
 
 /*
 apiConsole provides a websocket to send/receive internal commands.
+In text mode the websocket messages are the raw input and output texts. In json mode each message is a JSON frame, see Console RPC.go.
 
-Request:    GET /console
+Request:    GET /console?mode=[text|json]
 Result:     Upgrade to websocket. The websocket message are texts to read/write.
+
+	403 if the origin is not allowed
 */
-func apiConsole(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+func apiConsole(backend *core.Backend, checkOrigin func(r *http.Request) bool) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := webapi.WSUpgrader.Upgrade(w, r, nil)
+		mode := r.URL.Query().Get("mode")
+		if mode != "" && mode != "text" && mode != "json" {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		c, err := consoleUpgrader(checkOrigin).Upgrade(w, r, nil)
 		if err != nil {
 			// May happen if request is simple HTTP request.
 			return
 		}
 		defer c.Close()
 
-		bufferR := bytes.NewBuffer(make([]byte, 0, 4096))
-		bufferW := bytes.NewBuffer(make([]byte, 0, 4096))
+		// cancelling the context terminates the command handler immediately in case the websocket is closed
+		ctx, cancel := context.WithCancel(shutdownContext)
+		defer cancel()
 
-		// subscribe to any output sent to backend.Stdout
-		subscribeID := backend.Stdout.Subscribe(bufferW)
-		defer backend.Stdout.Unsubscribe(subscribeID)
+		// the API key of the request limits the commands of the session
+		if caller, ok := apiCallerFromContext(r.Context()); ok {
+			ctx = context.WithValue(ctx, apiCallerContextKey{}, caller)
+		}
+
+		// commands of the session are written to the audit log
+		if source := auditSourceFromContext(r.Context()); source != nil {
+			ctx = context.WithValue(ctx, auditSourceContextKey{}, source)
+		}
 
-		// the terminate signal is used to signal the command handler in case the websocket is closed
-		terminateSignal := make(chan struct{})
-		defer close(terminateSignal)
+		// on shutdown the websocket is closed, which ends the read loop
+		go func() {
+			<-ctx.Done()
+			c.Close()
+		}()
+
+		// all output is sent as messages through the console writer, which is safe for concurrent use
+		writer := newConsoleWriter(ctx, cancel)
+
+		// subscribe to any output sent to backend.Stdout. In json mode it is sent as log event.
+		var stdout io.Writer = writer
+		if mode == "json" {
+			stdout = &consoleEventWriter{event: consoleEventLog, frames: writer}
+		}
+		subscribeID := backend.Stdout.Subscribe(stdout)
+		defer func() {
+			// The context is cancelled first so that writes fail immediately.
+			cancel()
+			backend.Stdout.Unsubscribe(subscribeID)
+		}()
 
-		// start userCommands which handles the actual commands
-		go userCommands(backend, bufferR, bufferW, terminateSignal)
+		// start the command handler which executes the commands as soon as they arrive
+		input := make(chan string)
+		if mode == "json" {
+			go consoleRPC(ctx, backend, input, writer)
+		} else {
+			go userCommands(ctx, backend, input, writer, false)
+		}
 
-		// go routine to receive output from userCommands and forward to websocket
+		// go routine to receive output from userCommands and forward to websocket. It is the only writer to the websocket.
 		go func() {
-			bufferW2 := make([]byte, 4096)
 			for {
 				select {
-				case <-terminateSignal:
+				case message := <-writer.messages:
+					c.SetWriteDeadline(time.Now().Add(consoleWriteTimeout))
+					if err := c.WriteMessage(websocket.TextMessage, message); err != nil {
+						cancel()
+						return
+					}
+				case <-ctx.Done():
 					return
-				default:
-				}
-
-				countRead, err := bufferW.Read(bufferW2)
-				if err != nil || countRead == 0 {
-					time.Sleep(50 * time.Millisecond)
-					continue
 				}
-
-				c.WriteMessage(websocket.TextMessage, bufferW2[:countRead])
 			}
 		}()
 
@@ -136,49 +354,87 @@ func apiConsole(backend *core.Backend) func(w http.ResponseWriter, r *http.Reque
 				break
 			}
 
-			// make sure the message has the \n delimiter which is used to detect a line
-			if !bytes.HasSuffix(message, []byte{'\n'}) {
-				message = append(message, '\n')
+			// in json mode each message is a single request frame
+			if mode == "json" {
+				select {
+				case input <- string(message):
+				case <-ctx.Done():
+					return
+				}
+				continue
 			}
 
-			bufferR.Write(message)
+			// a single message may contain multiple lines
+			for _, line := range strings.Split(strings.TrimSuffix(string(message), "\n"), "\n") {
+				select {
+				case input <- line:
+				case <-ctx.Done():
+					return
+				}
+			}
 		}
 	}
 }
 
 /*
-apiShutdown gracefully shuts down the application. Actions: 0 = Shutdown.
+apiShutdown gracefully shuts down, restarts, or reloads the application. Actions: 0 = Shutdown, 1 = Restart, 2 = Reload.
+Shutdown: The API stops accepting requests and active transfers may complete until the shutdown timeout.
+Restart: Same as shutdown, then the application is started again with the same parameters. Refused if transfers are active, unless force=1.
+Reload: The API and log settings are reloaded from the config file. API settings provided via command line still override the reloaded settings.
+The response is sent before the action starts.
 
-Request:    GET /shutdown?action=[action]
+Request:    GET /shutdown?action=[action]&force=[0|1]
 Result:     200 with JSON structure apiShutdownStatus
 */
-func apiShutdown(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+func apiShutdown(backend *core.Backend, params *cmdParams) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		action, err := strconv.Atoi(r.Form.Get("action"))
-		if err != nil || action != 0 {
+		if err != nil || action < 0 || action > 2 {
 			http.Error(w, "", http.StatusBadRequest)
 			return
 		}
+		force := r.Form.Get("force") == "1"
+
+		status := apiShutdownStatus{ActiveTransfers: len(activeTransfers(backend))}
 
-		if action == 0 {
-			// Later: Initiate shutdown signal to core library and wait for all requests to complete.
+		switch {
+		case shutdownInProgress():
+			status.Status = 1
+		case action == 1 && status.ActiveTransfers > 0 && !force:
+			status.Status = 2
+		}
 
-			backend.LogError("apiShutdown", "graceful shutdown via API requested from '%s'\n", r.RemoteAddr)
+		EncodeJSONFlush(backend, w, r, &status)
 
-			EncodeJSONFlush(backend, w, r, &apiShutdownStatus{Status: 0})
+		if status.Status != 0 {
+			return
+		}
 
-			os.Exit(core.ExitGraceful)
+		switch action {
+		case 0:
+			go shutdownApplication(backend, "requested via API from '"+r.RemoteAddr+"'", false)
+		case 1:
+			go shutdownApplication(backend, "restart requested via API from '"+r.RemoteAddr+"'", true)
+		case 2:
+			backend.LogError("apiShutdown", "reload requested via API from '%s'\n", r.RemoteAddr)
+			go reloadSettings(backend, params)
 		}
 	}
 }
 
 type apiShutdownStatus struct {
-	Status int `json:"status"` // Status of the API call. 0 = Success.
+	Status          int `json:"status"`          // Status of the API call. 0 = Success (action accepted), 1 = Shutdown or restart already in progress, 2 = Restart refused because transfers are active.
+	ActiveTransfers int `json:"activetransfers"` // Count of active file and block transfers.
 }
 
 // EncodeJSONFlush encodes the data as JSON and flushes the writer. It sets the Content-Length header so no subsequent writes should be made.
 func EncodeJSONFlush(backend *core.Backend, w http.ResponseWriter, r *http.Request, data interface{}) (err error) {
+	return EncodeJSONFlushStatus(backend, w, r, http.StatusOK, data)
+}
+
+// EncodeJSONFlushStatus is the same as EncodeJSONFlush with a custom HTTP status code.
+func EncodeJSONFlushStatus(backend *core.Backend, w http.ResponseWriter, r *http.Request, statusCode int, data interface{}) (err error) {
 	response, err := json.Marshal(data)
 	if err != nil {
 		backend.LogError("EncodeJSONFlush", "error marshalling data for route '%s': %v\n", r.URL.Path, err)
@@ -187,7 +443,7 @@ func EncodeJSONFlush(backend *core.Backend, w http.ResponseWriter, r *http.Reque
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Content-Length", strconv.Itoa(len(response)))
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(statusCode)
 
 	_, err = w.Write(response)
 
@@ -208,19 +464,57 @@ func processExitMonitor(backend *core.Backend, watchPID int) {
 		return
 	}
 
+	if !processExists(watchPID) {
+		backend.LogError("processExitMonitor", "monitored process ID %d does not exist, process exit monitor not started\n", watchPID)
+		return
+	}
+
+	backend.LogError("processExitMonitor", "monitoring process ID %d for exit\n", watchPID)
+
 	// monitor the process
-	process, err := os.FindProcess(watchPID)
-	if err != nil {
-		backend.LogError("processExitMonitor", "error finding monitored process ID %d: %v\n", watchPID, err)
+	if err := processWaitExit(watchPID); err != nil {
+		backend.LogError("processExitMonitor", "error monitoring process ID %d: %v\n", watchPID, err)
 		return
 	}
 
-	_, err = process.Wait()
-	if err == nil {
-		backend.LogError("processExitMonitor", "graceful shutdown via exit signal from process ID %d\n", watchPID)
+	shutdownApplication(backend, "exit of monitored process ID "+strconv.Itoa(watchPID), false)
+}
+
+// consoleWriterQueue is the count of messages that are queued per console. If the queue is full, the console is disconnected.
+const consoleWriterQueue = 1024
+
+// consoleWriteTimeout is the maximum time to send a single message to the websocket. Clients that do not read in time are disconnected.
+const consoleWriteTimeout = 10 * time.Second
+
+// errConsoleQueueFull is returned by consoleWriter if the client does not read the output fast enough.
+var errConsoleQueueFull = errors.New("console output queue full")
+
+// consoleWriter is an io.Writer that forwards each write as a separate message. It is safe for concurrent use.
+// Writes never block, since backend.Stdout and the debug filters write to it while holding locks. If the queue is full the console is disconnected via the cancel function.
+type consoleWriter struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	messages chan []byte
+}
+
+func newConsoleWriter(ctx context.Context, cancel context.CancelFunc) *consoleWriter {
+	return &consoleWriter{ctx: ctx, cancel: cancel, messages: make(chan []byte, consoleWriterQueue)}
+}
+
+// Write queues a copy of p as a single message.
+func (writer *consoleWriter) Write(p []byte) (n int, err error) {
+	if err = writer.ctx.Err(); err != nil {
+		return 0, err
+	}
 
-		// Later: Initiate shutdown signal to core library and wait for all requests to complete.
+	message := make([]byte, len(p))
+	copy(message, p)
 
-		os.Exit(core.ExitGraceful)
+	select {
+	case writer.messages <- message:
+		return len(p), nil
+	default:
+		writer.cancel()
+		return 0, errConsoleQueueFull
 	}
 }
@@ -0,0 +1,156 @@
+/*
+File Name:  API_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Tests of the /console websocket. Run with the race detector: go test -race
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/gorilla/websocket"
+)
+
+// testConsoleServer starts a server providing /console. All origins are allowed.
+func testConsoleServer(t *testing.T, backend *core.Backend) (server *httptest.Server, dial func(mode string) *websocket.Conn) {
+	server = httptest.NewServer(http.HandlerFunc(apiConsole(backend, func(r *http.Request) bool { return true })))
+	t.Cleanup(server.Close)
+
+	dial = func(mode string) *websocket.Conn {
+		c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/console?mode="+mode, nil)
+		if err != nil {
+			t.Fatalf("error connecting to console: %v", err)
+		}
+		return c
+	}
+
+	return server, dial
+}
+
+// testConsoleReadUntil reads messages until one contains the text. It fails after the timeout.
+func testConsoleReadUntil(c *websocket.Conn, text string, timeout time.Duration) error {
+	c.SetReadDeadline(time.Now().Add(timeout))
+
+	for {
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("waiting for '%s': %w", text, err)
+		} else if strings.Contains(string(message), text) {
+			return nil
+		}
+	}
+}
+
+// TestConsoleConcurrentSessions runs many text and json console sessions in parallel while the backend writes output to all of them.
+func TestConsoleConcurrentSessions(t *testing.T) {
+	backend := testBackend(t)
+	_, dial := testConsoleServer(t, backend)
+
+	const sessions = 20
+	const commands = 10
+
+	// backend output is sent to all sessions while they execute commands
+	stopOutput := make(chan struct{})
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		for n := 0; ; n++ {
+			select {
+			case <-stopOutput:
+				return
+			case <-time.After(time.Millisecond):
+				fmt.Fprintf(backend.Stdout, "backend output %d\n", n)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errors := make(chan error, sessions)
+
+	for n := 0; n < sessions; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+
+			mode := "text"
+			if n%2 == 1 {
+				mode = "json"
+			}
+
+			c := dial(mode)
+			defer c.Close()
+
+			for m := 0; m < commands; m++ {
+				text := fmt.Sprintf("session %d command %d", n, m)
+				hash := hex.EncodeToString(core.Data2Hash([]byte(text)))
+
+				var err error
+				if mode == "json" {
+					request, _ := json.Marshal(consoleRequest{ID: json.RawMessage(fmt.Sprint(m)), Command: "hash", Args: []string{text}})
+					err = c.WriteMessage(websocket.TextMessage, request)
+				} else {
+					err = c.WriteMessage(websocket.TextMessage, []byte("hash "+text))
+				}
+				if err == nil {
+					err = testConsoleReadUntil(c, hash, 10*time.Second)
+				}
+				if err != nil {
+					errors <- fmt.Errorf("session %d (%s): %w", n, mode, err)
+					return
+				}
+			}
+		}(n)
+	}
+
+	wg.Wait()
+	close(stopOutput)
+	<-outputDone
+	close(errors)
+
+	for err := range errors {
+		t.Error(err)
+	}
+}
+
+// TestConsoleSlowClient checks that a client that does not read does not block backend output.
+func TestConsoleSlowClient(t *testing.T) {
+	backend := testBackend(t)
+	_, dial := testConsoleServer(t, backend)
+
+	c := dial("text")
+	defer c.Close()
+
+	// make sure the session is subscribed to the backend output before it stops reading
+	c.WriteMessage(websocket.TextMessage, []byte("hash subscribed"))
+	if err := testConsoleReadUntil(c, hex.EncodeToString(core.Data2Hash([]byte("subscribed"))), 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		line := strings.Repeat("x", 4096) + "\n"
+		for n := 0; n < 4*consoleWriterQueue; n++ {
+			fmt.Fprint(backend.Stdout, line)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(consoleWriteTimeout / 2):
+		t.Fatal("backend output blocked by console client that does not read")
+	}
+}
@@ -0,0 +1,436 @@
+/*
+File Name:  Audit.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Append-only audit log of API calls and console commands in the JSON lines format. Each line is a JSON document of auditEntry.
+The log file is rotated when it exceeds the maximum size: the current file is renamed to [file].1, the previous [file].1 to [file].2 and so on.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+)
+
+func init() {
+	registerCommand(&command{Name: "audit tail", Help: "Show the latest entries of the audit log", Handler: cmdAuditTail, Admin: true,
+		Args: []commandArgument{{Name: "count", Prompt: "Enter the count of entries to show:"}}})
+}
+
+// auditLogNone disables the audit log if used as file name.
+const auditLogNone = "none"
+
+// Defaults for the rotation of the audit log.
+const (
+	auditLogMaxSizeDefault  = 10 // Maximum size of the log file in MB before it is rotated.
+	auditLogMaxFilesDefault = 5  // Count of rotated files to keep.
+)
+
+// auditEntry is a single entry in the audit log.
+type auditEntry struct {
+	Time     time.Time `json:"time"`              // Time of the API call or command.
+	Remote   string    `json:"remote"`            // Remote address of the client.
+	Key      string    `json:"key,omitempty"`     // Name of the API key. Empty if no API key is used or the key is invalid.
+	Endpoint string    `json:"endpoint"`          // Path of the API endpoint.
+	Method   string    `json:"method,omitempty"`  // HTTP method. Only for API calls.
+	Status   int       `json:"status,omitempty"`  // HTTP status code of the response. Only for API calls.
+	Command  string    `json:"command,omitempty"` // Command line. Only for console commands.
+	Result   string    `json:"result,omitempty"`  // Result of the command: success, failed, denied. Only for console commands.
+}
+
+// auditLog is the active audit log. Nil if disabled.
+var auditLog *auditWriter
+
+// auditWriter writes entries to the log file and rotates it.
+type auditWriter struct {
+	filename string
+	maxSize  int64 // Maximum size of the file in bytes before it is rotated.
+	maxFiles int   // Count of rotated files to keep.
+
+	sync.Mutex
+	file *os.File
+	size int64
+}
+
+// auditStart opens the audit log. If the file name is "none", the audit log is disabled.
+// If the file name is empty, the default file name next to the config file is used, for example "Config.audit.log" for "Config.yaml".
+func auditStart(filename string, maxSizeMB, maxFiles int) (err error) {
+	if filename == auditLogNone {
+		return nil
+	} else if filename == "" {
+		filename = strings.TrimSuffix(configFile, filepath.Ext(configFile)) + ".audit.log"
+	}
+	if maxSizeMB <= 0 {
+		maxSizeMB = auditLogMaxSizeDefault
+	}
+	if maxFiles <= 0 {
+		maxFiles = auditLogMaxFilesDefault
+	}
+
+	writer := &auditWriter{filename: filename, maxSize: int64(maxSizeMB) * 1024 * 1024, maxFiles: maxFiles}
+	if err = writer.open(); err != nil {
+		return err
+	}
+
+	auditLog = writer
+	return nil
+}
+
+func (writer *auditWriter) open() (err error) {
+	if writer.file, err = os.OpenFile(writer.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+
+	stat, err := writer.file.Stat()
+	if err != nil {
+		writer.file.Close()
+		return err
+	}
+	writer.size = stat.Size()
+
+	return nil
+}
+
+// rotate renames the current file to [file].1 after shifting the older files and opens a new file.
+func (writer *auditWriter) rotate() (err error) {
+	writer.file.Close()
+
+	os.Remove(writer.filename + "." + strconv.Itoa(writer.maxFiles))
+	for n := writer.maxFiles - 1; n >= 1; n-- {
+		os.Rename(writer.filename+"."+strconv.Itoa(n), writer.filename+"."+strconv.Itoa(n+1))
+	}
+	os.Rename(writer.filename, writer.filename+".1")
+
+	return writer.open()
+}
+
+// write appends the entry to the log file.
+func (writer *auditWriter) write(entry *auditEntry) (err error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	writer.Lock()
+	defer writer.Unlock()
+
+	if writer.size > 0 && writer.size+int64(len(line)) > writer.maxSize {
+		if err = writer.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := writer.file.Write(line)
+	writer.size += int64(n)
+
+	return err
+}
+
+// auditWrite writes the entry to the audit log, if enabled.
+func auditWrite(backend *core.Backend, entry *auditEntry) {
+	if auditLog == nil {
+		return
+	}
+
+	if err := auditLog.write(entry); err != nil {
+		backend.LogError("auditWrite", "error writing audit log '%s': %v\n", auditLog.filename, err)
+	}
+}
+
+// auditFilter selects entries when reading the audit log. Empty fields match all entries.
+type auditFilter struct {
+	Key      string    // Name of the API key.
+	Endpoint string    // Path of the API endpoint.
+	Remote   string    // Remote IP address.
+	Since    time.Time // Minimum time.
+}
+
+func (filter *auditFilter) match(entry *auditEntry) bool {
+	if filter.Key != "" && entry.Key != filter.Key || filter.Endpoint != "" && entry.Endpoint != filter.Endpoint {
+		return false
+	} else if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+		return false
+	} else if filter.Remote != "" {
+		host, _, err := net.SplitHostPort(entry.Remote)
+		if err != nil {
+			host = entry.Remote
+		}
+		return host == filter.Remote
+	}
+	return true
+}
+
+// auditReadChunkSize is the size of the blocks in which the audit log is read backwards.
+const auditReadChunkSize = 64 * 1024
+
+// auditRead returns the latest entries matching the filter, oldest first. The files are read backwards starting with the current one until enough entries are found.
+// The write lock is only held to get the current size of the file, so that reading does not block API calls.
+func auditRead(filter *auditFilter, count int) (entries []auditEntry, err error) {
+	if auditLog == nil || count <= 0 {
+		return nil, nil
+	}
+
+	auditLog.Lock()
+	filename, size, maxFiles := auditLog.filename, auditLog.size, auditLog.maxFiles
+	auditLog.Unlock()
+
+	// Entries are collected newest first and reversed at the end.
+	for n := 0; n <= maxFiles && len(entries) < count; n++ {
+		var done bool
+		if n == 0 {
+			entries, done, err = auditReadBackwards(filename, size, filter, count, entries)
+		} else {
+			entries, done, err = auditReadBackwards(filename+"."+strconv.Itoa(n), -1, filter, count, entries)
+		}
+
+		if os.IsNotExist(err) {
+			// The file may have been rotated meanwhile, or there are no older files.
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if done {
+			break
+		}
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	return entries, nil
+}
+
+// auditReadBackwards reads the lines of the file backwards from the offset and appends matching entries until count entries are collected. An offset of -1 reads from the end of the file.
+// If the file is shorter than the offset, it was rotated after the offset was taken and is read from its end.
+// Done indicates that no further files need to be read, either because enough entries are found or because the entries are older than the filter allows.
+func auditReadBackwards(filename string, offset int64, filter *auditFilter, count int, entries []auditEntry) (result []auditEntry, done bool, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return entries, false, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return entries, false, err
+	} else if offset < 0 || offset > stat.Size() {
+		offset = stat.Size()
+	}
+
+	// partial is the start of the last line which was not yet fully read.
+	var partial []byte
+
+	for offset > 0 {
+		chunkSize := int64(auditReadChunkSize)
+		if offset < chunkSize {
+			chunkSize = offset
+		}
+		offset -= chunkSize
+
+		data := make([]byte, chunkSize, chunkSize+int64(len(partial)))
+		if _, err := file.ReadAt(data, offset); err != nil {
+			return entries, false, err
+		}
+		data = append(data, partial...)
+
+		// Process all complete lines from the end. The first line is only complete at the start of the file.
+		for len(data) > 0 {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 && offset > 0 {
+				break
+			}
+
+			line := data[i+1:]
+			if i < 0 {
+				data = nil
+			} else {
+				data = data[:i]
+			}
+
+			var entry auditEntry
+			if len(line) == 0 || json.Unmarshal(line, &entry) != nil {
+				continue
+			} else if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+				return entries, true, nil
+			} else if filter.match(&entry) {
+				if entries = append(entries, entry); len(entries) >= count {
+					return entries, true, nil
+				}
+			}
+		}
+
+		partial = data
+	}
+
+	return entries, false, nil
+}
+
+// auditSource identifies the client of an API call. It is shared via the request context, so the authentication can set the key and console sessions can log their commands.
+type auditSource struct {
+	Remote   string // Remote address.
+	Key      string // Name of the API key. Empty if not used or not yet authenticated.
+	Endpoint string // Path of the API endpoint.
+}
+
+type auditSourceContextKey struct{}
+
+// auditSourceFromContext returns the source of the API call or console session. Nil if not available, for example on the command line.
+func auditSourceFromContext(ctx context.Context) (source *auditSource) {
+	source, _ = ctx.Value(auditSourceContextKey{}).(*auditSource)
+	return source
+}
+
+// auditMiddleware returns a middleware that logs each API call after it completes. It must be the first middleware so that refused requests are logged as well.
+func auditMiddleware(backend *core.Backend) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if auditLog == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			source := &auditSource{Remote: r.RemoteAddr, Endpoint: r.URL.Path}
+			entry := auditEntry{Time: time.Now().UTC(), Remote: source.Remote, Endpoint: source.Endpoint, Method: r.Method}
+
+			recorder := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditSourceContextKey{}, source)))
+
+			entry.Key = source.Key
+			entry.Status = recorder.status
+			auditWrite(backend, &entry)
+		})
+	}
+}
+
+// auditCommand logs a command executed in a console session via the API. Commands on the command line are not logged.
+func auditCommand(ctx context.Context, backend *core.Backend, line, result string) {
+	source := auditSourceFromContext(ctx)
+	if source == nil {
+		return
+	}
+
+	auditWrite(backend, &auditEntry{Time: time.Now().UTC(), Remote: source.Remote, Key: source.Key, Endpoint: source.Endpoint, Command: line, Result: result})
+}
+
+// auditResponseWriter records the status code of the response. It supports websocket upgrades and flushing.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(statusCode int) {
+	w.status = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *auditResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijacking not supported")
+	}
+
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+/*
+apiAudit returns the latest entries of the audit log, oldest first.
+
+Request:    GET /audit?count=[count]&key=[key name]&endpoint=[path]&remote=[IP]&since=[RFC 3339 time]
+
+	All parameters are optional. The default count is 100.
+
+Result:     200 with JSON array of auditEntry
+
+	400 if a parameter is invalid
+*/
+func apiAudit(backend *core.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		count := 100
+		if countA := r.Form.Get("count"); countA != "" {
+			var err error
+			if count, err = strconv.Atoi(countA); err != nil || count <= 0 {
+				http.Error(w, "", http.StatusBadRequest)
+				return
+			}
+		}
+
+		filter := auditFilter{Key: r.Form.Get("key"), Endpoint: r.Form.Get("endpoint"), Remote: r.Form.Get("remote")}
+		if sinceA := r.Form.Get("since"); sinceA != "" {
+			var err error
+			if filter.Since, err = time.Parse(time.RFC3339, sinceA); err != nil {
+				http.Error(w, "", http.StatusBadRequest)
+				return
+			}
+		}
+
+		entries, err := auditRead(&filter, count)
+		if err != nil {
+			backend.LogError("apiAudit", "error reading audit log: %v\n", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if entries == nil {
+			entries = []auditEntry{}
+		}
+
+		EncodeJSONFlush(backend, w, r, entries)
+	}
+}
+
+func cmdAuditTail(session *commandSession) {
+	count, valid, terminate := session.argInt(0)
+	if terminate {
+		return
+	} else if !valid || count <= 0 {
+		session.errorf("Invalid count.\n")
+		return
+	} else if auditLog == nil {
+		session.errorf("The audit log is disabled.\n")
+		return
+	}
+
+	entries, err := auditRead(&auditFilter{}, count)
+	if err != nil {
+		session.errorf("Error reading audit log: %s\n", err.Error())
+		return
+	}
+
+	for n := range entries {
+		entry := &entries[n]
+		if session.output.JSON {
+			session.output.writeJSON(entry)
+			continue
+		}
+
+		target := entry.Method + " " + entry.Endpoint + " " + strconv.Itoa(entry.Status)
+		if entry.Command != "" {
+			target = entry.Endpoint + " " + entry.Result + ": " + entry.Command
+		}
+		fmt.Fprintf(session.output, "%s  %-40s  %-12s  %s\n", entry.Time.Local().Format(dateFormat), entry.Remote, entry.Key, target)
+	}
+}
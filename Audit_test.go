@@ -0,0 +1,186 @@
+/*
+File Name:  Audit_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Tests of reading the audit log and the redaction of sensitive command arguments.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAuditLog starts an audit log in a temporary folder with the given maximum size and count of rotated files. It is stopped at the end of the test.
+func testAuditLog(t *testing.T, maxSize int64, maxFiles int) (filename string) {
+	filename = filepath.Join(t.TempDir(), "audit.log")
+	if err := auditStart(filename, 1, maxFiles); err != nil {
+		t.Fatal(err)
+	}
+	auditLog.maxSize = maxSize
+
+	t.Cleanup(func() {
+		auditLog.file.Close()
+		auditLog = nil
+	})
+
+	return filename
+}
+
+// testAuditWrite writes count entries one second apart. The endpoint is /n with n the index of the entry, entries with even index use the key "even".
+// The command is padded to a different length per entry so that lines end at various offsets within the read chunks.
+func testAuditWrite(t *testing.T, start time.Time, count int) {
+	for n := 0; n < count; n++ {
+		entry := &auditEntry{Time: start.Add(time.Duration(n) * time.Second), Remote: "192.0.2.1:" + strconv.Itoa(1000+n), Endpoint: "/" + strconv.Itoa(n), Command: strings.Repeat("x", n%97)}
+		if n%2 == 0 {
+			entry.Key = "even"
+		}
+		if err := auditLog.write(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// testAuditEndpoints checks that the entries have the expected endpoints in this order.
+func testAuditEndpoints(t *testing.T, entries []auditEntry, expected ...int) {
+	t.Helper()
+
+	if len(entries) != len(expected) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(expected))
+	}
+	for n := range entries {
+		if entries[n].Endpoint != "/"+strconv.Itoa(expected[n]) {
+			t.Fatalf("entry %d: got endpoint %s, want /%d", n, entries[n].Endpoint, expected[n])
+		}
+	}
+}
+
+// TestAuditRead writes enough entries to span multiple read chunks and checks the count and the filters.
+func TestAuditRead(t *testing.T) {
+	testAuditLog(t, 100*1024*1024, 3)
+
+	const total = 2000
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	testAuditWrite(t, start, total)
+
+	if auditLog.size <= 2*auditReadChunkSize {
+		t.Fatalf("audit log too small to span multiple chunks: %d bytes", auditLog.size)
+	}
+
+	// all entries, oldest first
+	entries, err := auditRead(&auditFilter{}, total+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != total {
+		t.Fatalf("got %d entries, want %d", len(entries), total)
+	}
+	for n := range entries {
+		if entries[n].Endpoint != "/"+strconv.Itoa(n) || len(entries[n].Command) != n%97 {
+			t.Fatalf("entry %d invalid: %+v", n, entries[n])
+		}
+	}
+
+	// count
+	entries, _ = auditRead(&auditFilter{}, 3)
+	testAuditEndpoints(t, entries, total-3, total-2, total-1)
+
+	entries, _ = auditRead(&auditFilter{}, 0)
+	testAuditEndpoints(t, entries)
+
+	// filters
+	entries, _ = auditRead(&auditFilter{Key: "even"}, 3)
+	testAuditEndpoints(t, entries, total-6, total-4, total-2)
+
+	entries, _ = auditRead(&auditFilter{Endpoint: "/17"}, 10)
+	testAuditEndpoints(t, entries, 17)
+
+	entries, _ = auditRead(&auditFilter{Remote: "192.0.2.1"}, 2)
+	testAuditEndpoints(t, entries, total-2, total-1)
+
+	entries, _ = auditRead(&auditFilter{Remote: "192.0.2.2"}, 2)
+	testAuditEndpoints(t, entries)
+
+	entries, _ = auditRead(&auditFilter{Since: start.Add((total - 4) * time.Second)}, 100)
+	testAuditEndpoints(t, entries, total-4, total-3, total-2, total-1)
+
+	entries, _ = auditRead(&auditFilter{Key: "even", Since: start.Add((total - 4) * time.Second)}, 100)
+	testAuditEndpoints(t, entries, total-4, total-2)
+}
+
+// TestAuditReadRotated checks that entries are read across rotated files and that only the configured count of rotated files is kept.
+func TestAuditReadRotated(t *testing.T) {
+	filename := testAuditLog(t, 1000, 2)
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	testAuditWrite(t, start, 100)
+
+	entries, err := auditRead(&auditFilter{}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The current file and 2 rotated files each hold a few entries. The oldest entries were removed.
+	if len(entries) == 0 || len(entries) >= 100 {
+		t.Fatalf("got %d entries", len(entries))
+	}
+	first, _ := strconv.Atoi(strings.TrimPrefix(entries[0].Endpoint, "/"))
+	expected := make([]int, 0, len(entries))
+	for n := first; n < 100; n++ {
+		expected = append(expected, n)
+	}
+	testAuditEndpoints(t, entries, expected...)
+
+	// Entries of the rotated files are used if the current file does not contain enough.
+	entries, _ = auditRead(&auditFilter{}, len(expected)-1)
+	testAuditEndpoints(t, entries, expected[1:]...)
+
+	// If the file was rotated after the offset was taken, the new shorter file is read from its end.
+	entries, _, err = auditReadBackwards(filename, 1<<30, &auditFilter{}, 1, nil)
+	if err != nil {
+		t.Fatalf("error reading rotated file: %v", err)
+	}
+	testAuditEndpoints(t, entries, 99)
+}
+
+// TestAuditLineRedaction checks that sensitive arguments are redacted in the command line written to the audit log.
+func TestAuditLineRedaction(t *testing.T) {
+	key := "4b5ed4d1-84c2-4c55-b2b0-a4c0b5c4cd1e"
+
+	tokens := []string{"api", "key", "hash", key}
+	cmd, args := lookupCommandLine(tokens)
+	if cmd == nil || cmd.Name != "api key hash" {
+		t.Fatal("command api key hash not found")
+	}
+	if line := cmd.auditLine(tokens, len(tokens)-len(args)); line != "api key hash [redacted]" || strings.Contains(line, key) {
+		t.Fatalf("key not redacted: %s", line)
+	}
+
+	// Only sensitive arguments are redacted, including the additional tokens of a sensitive rest argument.
+	cmdTest := &command{Name: "test", Args: []commandArgument{{Name: "name"}, {Name: "secret", Sensitive: true, Rest: true}}}
+	tests := []struct {
+		tokens []string
+		want   string
+	}{
+		{[]string{"test"}, "test"},
+		{[]string{"test", "alice"}, "test alice"},
+		{[]string{"test", "alice", "s3cret"}, "test alice [redacted]"},
+		{[]string{"test", "alice", "two", "words"}, "test alice [redacted] [redacted]"},
+	}
+	for _, test := range tests {
+		if line := cmdTest.auditLine(test.tokens, 1); line != test.want {
+			t.Errorf("got '%s', want '%s'", line, test.want)
+		}
+	}
+
+	// Without command the line is unchanged.
+	var unknown *command
+	if line := unknown.auditLine([]string{"unknown", key}, 1); line != "unknown "+key {
+		t.Fatalf("got '%s'", line)
+	}
+}
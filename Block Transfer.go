@@ -10,18 +10,68 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/PeernetOfficial/core"
 	"github.com/PeernetOfficial/core/blockchain"
 	"github.com/PeernetOfficial/core/protocol"
+	"github.com/PeernetOfficial/core/webapi"
 )
 
 const maxBlockSize = 1 * 1024 * 1024
 
-func blockTransfer(peer *core.PeerInfo, blockNumber uint64, output io.Writer) {
+func init() {
+	registerCommand(&command{Name: "get block", Help: "Get block from remote peer", Handler: cmdGetBlock,
+		Args: []commandArgument{{Name: "peer", Prompt: "Enter peer ID or node ID:"}, {Name: "block number", Prompt: "Enter block number:"}}})
+}
+
+func cmdGetBlock(session *commandSession) {
+	nodeIDA, _, terminate := session.argString(0)
+	if terminate {
+		return
+	}
+	blockNumber, valid, terminate := session.argInt(1)
+	if terminate {
+		return
+	} else if !valid {
+		session.errorf("Invalid block number.\n")
+		return
+	}
+
+	nodeID, valid2 := webapi.DecodeBlake3Hash(nodeIDA)
+	publicKey, err3 := core.PublicKeyFromPeerID(nodeIDA)
+
+	if !valid2 && err3 != nil {
+		session.errorf("Invalid peer ID or node ID.\n")
+		return
+	} else if blockNumber < 0 {
+		session.errorf("Invalid block number.\n")
+		return
+	}
+
+	var peer *core.PeerInfo
+	var err error
+	timeout := time.Second * 10
+
+	if valid2 {
+		peer, err = webapi.PeerConnectNode(session.backend, nodeID, timeout)
+	} else if err3 == nil {
+		peer, err = webapi.PeerConnectPublicKey(session.backend, publicKey, timeout)
+	}
+	if err != nil {
+		session.errorf("Could not connect to peer: %s\n", err.Error())
+		return
+	}
+
+	output := session.output
+	session.background(func() bool { return blockTransfer(peer, uint64(blockNumber), output) })
+}
+
+// blockTransfer downloads the block from the remote peer and prints its decoded records.
+func blockTransfer(peer *core.PeerInfo, blockNumber uint64, output commandOutput) (success bool) {
 	conn, _, err := peer.BlockTransferRequest(peer.PublicKey, 1, maxBlockSize, []protocol.BlockRange{{Offset: uint64(blockNumber), Limit: 1}})
 	if err != nil {
-		fmt.Fprintf(output, "Error starting block transfer: %s\n", err.Error())
+		output.errorf("Error starting block transfer: %s\n", err.Error())
 		return
 	}
 
@@ -29,32 +79,37 @@ func blockTransfer(peer *core.PeerInfo, blockNumber uint64, output io.Writer) {
 	conn.Close()
 
 	if err != nil {
-		fmt.Fprintf(output, "Error reading block (indicated block size %d) from remote: %s\n", blockSize, err.Error())
+		output.errorf("Error reading block (indicated block size %d) from remote: %s\n", blockSize, err.Error())
 		return
 	} else if targetBlock.Limit != 1 || targetBlock.Offset != blockNumber {
-		fmt.Fprintf(output, "Error mismatch requested block %d with returned block %d (count %d)\n", blockNumber, targetBlock.Offset, targetBlock.Limit)
+		output.errorf("Error mismatch requested block %d with returned block %d (count %d)\n", blockNumber, targetBlock.Offset, targetBlock.Limit)
 		return
 	} else if availability == protocol.GetBlockStatusNotAvailable { // Block range not available
-		fmt.Fprintf(output, "Error requested block %d not available\n", blockNumber)
+		output.errorf("Error requested block %d not available\n", blockNumber)
 		return
 	} else if availability == protocol.GetBlockStatusSizeExceed { // Block range exceeds size limit
-		fmt.Fprintf(output, "Error block %d reported by remote as exceeding size %d (limit %d)\n", blockNumber, blockSize, maxBlockSize)
+		output.errorf("Error block %d reported by remote as exceeding size %d (limit %d)\n", blockNumber, blockSize, maxBlockSize)
 		return
 	} else if availability != protocol.GetBlockStatusAvailable {
-		fmt.Fprintf(output, "Error requested block %d unknown availability indicator %d\n", blockNumber, availability)
+		output.errorf("Error requested block %d unknown availability indicator %d\n", blockNumber, availability)
 		return
 	}
 
 	decoded, status, err := blockchain.DecodeBlockRaw(data)
 
 	if err != nil {
-		fmt.Fprintf(output, "Error decoding block: %s\n", err.Error())
+		output.errorf("Error decoding block: %s\n", err.Error())
 		return
 	} else if status != blockchain.StatusOK {
-		fmt.Fprintf(output, "Error decoding block status is %d\n", status)
+		output.errorf("Error decoding block status is %d\n", status)
 		return
 	}
 
+	if output.JSON {
+		output.writeJSON(blockToJSON(peer, decoded, len(data)))
+		return true
+	}
+
 	fmt.Fprintf(output, "Block %d from %s: version %d, number %d, block size %d, decoded %d records\n", blockNumber, hex.EncodeToString(peer.PublicKey.SerializeCompressed()), decoded.BlockchainVersion, decoded.Number, len(data), len(decoded.RecordsDecoded))
 
 	for _, decodedR := range decoded.RecordsDecoded {
@@ -68,6 +123,44 @@ func blockTransfer(peer *core.PeerInfo, blockNumber uint64, output io.Writer) {
 			fmt.Fprintf(output, "* Unknown record.\n")
 		}
 	}
+
+	return true
+}
+
+func blockToJSON(peer *core.PeerInfo, decoded *blockchain.BlockDecoded, size int) (result jsonBlock) {
+	result = jsonBlock{
+		PeerID:            hex.EncodeToString(peer.PublicKey.SerializeCompressed()),
+		BlockNumber:       decoded.Number,
+		BlockchainVersion: decoded.BlockchainVersion,
+		Size:              size,
+		Files:             []jsonBlockFile{},
+		Profile:           []jsonProfileField{},
+	}
+
+	for _, decodedR := range decoded.RecordsDecoded {
+		if file, ok := decodedR.(blockchain.BlockRecordFile); ok {
+			info := jsonBlockFile{ID: file.ID.String(), Hash: hex.EncodeToString(file.Hash), MerkleRootHash: hex.EncodeToString(file.MerkleRootHash), FragmentSize: file.FragmentSize, Size: file.Size, Type: file.Type, Format: file.Format}
+			for _, tag := range file.Tags {
+				switch tag.Type {
+				case blockchain.TagName:
+					info.Name = tag.Text()
+				case blockchain.TagFolder:
+					info.Folder = tag.Text()
+				case blockchain.TagDescription:
+					info.Description = tag.Text()
+				}
+			}
+			result.Files = append(result.Files, info)
+		} else if recordsProfile, ok := decodedR.([]blockchain.BlockRecordProfile); ok {
+			for _, recordP := range recordsProfile {
+				result.Profile = append(result.Profile, jsonProfileField{Type: recordP.Type, Data: hex.EncodeToString(recordP.Data)})
+			}
+		} else {
+			result.UnknownRecords++
+		}
+	}
+
+	return result
 }
 
 func blockPrintFile(file blockchain.BlockRecordFile, output io.Writer) {
@@ -0,0 +1,101 @@
+/*
+File Name:  Command Batch.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Non-interactive execution of commands via the -exec and -script parameters.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// runBatch executes the commands provided via the -exec and -script parameters and returns the exit code.
+// The -exec command is executed first, followed by the commands from the script file.
+func runBatch(backend *core.Backend, params *cmdParams) (exitCode int) {
+	output := commandOutput{Writer: os.Stdout, JSON: params.OutputJSON}
+
+	var input []byte
+
+	if params.Exec != "" {
+		input = append(input, params.Exec+"\n"...)
+	}
+	if params.Script != "" {
+		data, err := os.ReadFile(params.Script)
+		if err != nil {
+			output.errorf("Error reading script file '%s': %s\n", params.Script, err.Error())
+			return ExitScriptRead
+		}
+		input = append(input, data...)
+	}
+
+	if params.WaitPeers > 0 {
+		if !output.JSON {
+			fmt.Fprintf(output, "Waiting for %d peers (timeout %s).\n", params.WaitPeers, params.WaitTimeout.String())
+		}
+		if !waitForPeers(backend, params.WaitPeers, params.WaitTimeout) {
+			output.errorf("Timeout waiting for peers. Connected to %d peers.\n", backend.PeerlistCount())
+			return ExitWaitPeersTimeout
+		}
+	}
+
+	if failed := runCommands(backend, strings.NewReader(string(input)), os.Stdout, params.OutputJSON); failed > 0 {
+		if !output.JSON {
+			fmt.Fprintf(output, "%d command(s) failed.\n", failed)
+		}
+		return ExitCommandFailed
+	}
+
+	return core.ExitSuccess
+}
+
+// runCommands executes all commands from the input non-interactively and returns the count of failed commands.
+// Arguments that are not provided inline are read from the subsequent lines. Empty lines and lines starting with # are ignored.
+// Background operations such as transfers are executed synchronously.
+func runCommands(backend *core.Backend, input io.Reader, output io.Writer, outputJSON bool) (failed int) {
+	ctx := context.Background()
+
+	session := newCommandSession(ctx, backend, readLines(ctx, input), output, outputJSON)
+	session.synchronous = true
+	defer session.close()
+
+	for {
+		text, _, terminate := getUserOptionString(ctx, session.input)
+		if terminate {
+			return failed
+		} else if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if !session.output.JSON {
+			fmt.Fprintf(output, "> %s\n", text)
+		}
+
+		if !session.execute(text) {
+			failed++
+		}
+	}
+}
+
+// waitForPeers waits until the peer list contains at least the count of peers. It returns false in case of timeout.
+func waitForPeers(backend *core.Backend, count int, timeout time.Duration) bool {
+	timeStart := time.Now()
+
+	for backend.PeerlistCount() < count {
+		if time.Since(timeStart) >= timeout {
+			return false
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	return true
+}
@@ -11,7 +11,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/PeernetOfficial/core"
@@ -20,73 +22,249 @@ import (
 	"github.com/PeernetOfficial/core/protocol"
 )
 
-// debugCmdConnect connects to the node ID
-func debugCmdConnect(backend *core.Backend, nodeID []byte, output io.Writer) {
-	fmt.Fprintf(output, "---------------- Connect to node %s ----------------\n", hex.EncodeToString(nodeID))
-	defer fmt.Fprintf(output, "---------------- done node %s ----------------\n", hex.EncodeToString(nodeID))
+func init() {
+	registerCommand(&command{Name: "debug key create", Help: "Create Public-Private Key pair", Handler: cmdDebugKeyCreate, Admin: true})
+	registerCommand(&command{Name: "debug key self", Help: "List current Public-Private Key pair", Handler: cmdDebugKeySelf, Admin: true})
+	registerCommand(&command{Name: "debug connect", Help: "Attempts to connect to the target peer", Handler: cmdDebugConnect,
+		Args: []commandArgument{{Name: "peer", Prompt: "Please specify the target peer to connect to via DHT lookup, either by peer ID or node ID:"}}})
+	registerCommand(&command{Name: "debug watch searches", Help: "Watch all outgoing DHT searches", Handler: cmdDebugWatchSearches,
+		Args: []commandArgument{{Name: "1|0", Prompt: "Enable (1) or disable (0) watching of all outgoing DHT searches?"}}})
+	registerCommand(&command{Name: "debug watch incoming", Help: "Watch all incoming information requests", Handler: cmdDebugWatchIncoming,
+		Args: []commandArgument{{Name: "1|0", Prompt: "Enable (1) or disable (0) watching of all incoming information requests?"}}})
+	registerCommand(&command{Name: "debug watch", Help: "Watch packets and info requests for hash", Handler: cmdDebugWatch,
+		Args: []commandArgument{{Name: "hash", Prompt: "Enter hash of data or node ID to watch. This monitors info requests and packets. Enter same hash again to remove from list."}}})
+	registerCommand(&command{Name: "debug bucket refresh", Help: "Disable or enable the DHT bucket refresh", Handler: cmdDebugBucketRefresh,
+		Args: []commandArgument{{Name: "1|0", Prompt: "Disable (1) or enable (0) bucket refresh. This can be useful to disable bucket refresh when debugging outgoing DHT searches."}}})
+}
+
+func cmdDebugKeyCreate(session *commandSession) {
+	privateKey, publicKey, err := core.Secp256k1NewPrivateKey()
+	if err != nil {
+		session.errorf("Error: %s\n", err.Error())
+		return
+	}
+
+	session.printKeyPair(privateKey, publicKey)
+}
+
+func cmdDebugKeySelf(session *commandSession) {
+	privateKey, publicKey := session.backend.ExportPrivateKey()
+	session.printKeyPair(privateKey, publicKey)
+}
+
+func (session *commandSession) printKeyPair(privateKey *btcec.PrivateKey, publicKey *btcec.PublicKey) {
+	if session.output.JSON {
+		session.output.writeJSON(jsonKeyPair{PrivateKey: hex.EncodeToString(privateKey.Serialize()), PublicKey: hex.EncodeToString(publicKey.SerializeCompressed())})
+		return
+	}
+
+	fmt.Fprintf(session.output, "Private Key: %s\n", hex.EncodeToString(privateKey.Serialize()))
+	fmt.Fprintf(session.output, "Public Key:  %s\n", hex.EncodeToString(publicKey.SerializeCompressed()))
+}
+
+func cmdDebugConnect(session *commandSession) {
+	text, valid, terminate := session.argString(0)
+	if terminate {
+		return
+	} else if !valid || (len(text) != 66 && len(text) != 64) {
+		session.errorf("Invalid peer ID or node ID. It must be hex-encoded and 66 (peer ID) or 64 characters (node ID) long.\n")
+		return
+	}
+
+	// node ID is required
+	var nodeID []byte
+	var err error
+
+	if len(text) == 66 {
+		// Assume peer ID was supplied.
+		publicKeyB, err := hex.DecodeString(text)
+		if err != nil || len(publicKeyB) != 33 {
+			session.errorf("Invalid peer ID encoding.\n")
+			return
+		}
+
+		publicKey, err := btcec.ParsePubKey(publicKeyB, btcec.S256())
+		if err != nil {
+			session.errorf("Invalid peer ID (public key decoding failed).\n")
+			return
+		}
+
+		nodeID = protocol.PublicKey2NodeID(publicKey)
+	} else {
+		// Node ID was supplied.
+		if nodeID, err = hex.DecodeString(text); err != nil || len(nodeID) != 256/8 {
+			session.errorf("Invalid node ID encoding.\n")
+			return
+		}
+	}
+
+	// is self?
+	if bytes.Equal(nodeID, session.backend.SelfNodeID()) {
+		session.errorf("Target node is self.\n")
+		return
+	}
+
+	if !debugCmdConnect(session.backend, nodeID, session.output) {
+		session.failed = true
+	}
+}
+
+func cmdDebugWatchSearches(session *commandSession) {
+	session.debugWatchAll(keyMonitorAllSearches)
+}
+
+func cmdDebugWatchIncoming(session *commandSession) {
+	session.debugWatchAll(keyMonitorAllRequests)
+}
+
+// debugWatchAll enables or disables monitoring of the special key based on the user's choice.
+func (session *commandSession) debugWatchAll(key string) {
+	number, valid, terminate := session.argInt(0)
+	if terminate {
+		return
+	} else if !valid || number < 0 || number > 1 {
+		session.errorf("Invalid option.\n")
+		return
+	}
+
+	if number == 1 {
+		hashMonitorControl([]byte(key), session.monitorID, 0, session.output)
+	} else {
+		hashMonitorControl([]byte(key), session.monitorID, 1, nil)
+	}
+}
+
+func cmdDebugBucketRefresh(session *commandSession) {
+	session.output.textf("Current setting: bucket refresh disabled = %t\n", dht.DisableBucketRefresh)
+	if number, valid, terminate := session.argInt(0); valid && number >= 0 && number <= 1 {
+		dht.DisableBucketRefresh = number == 1
+		if session.output.JSON {
+			session.output.writeJSON(jsonBucketRefresh{Disabled: dht.DisableBucketRefresh})
+		}
+	} else if !terminate {
+		session.errorf("Invalid option.\n")
+	}
+}
+
+func cmdDebugWatch(session *commandSession) {
+	text, _, terminate := session.argString(0)
+	if terminate {
+		return
+	}
+	var hash []byte
+	var err error
+	if hash, err = hex.DecodeString(text); err != nil || len(hash) != 256/8 {
+		session.errorf("Invalid hash. Hex-encoded 64 character hash expected.\n")
+		return
+	}
+
+	added := hashMonitorControl(hash, session.monitorID, 2, session.output)
+	if session.output.JSON {
+		session.output.writeJSON(jsonMonitor{Key: hex.EncodeToString(hash), Monitored: added})
+	} else if added {
+		fmt.Fprintf(session.output, "The hash was added to the monitoring list.\n")
+	} else {
+		fmt.Fprintf(session.output, "The hash was removed from the monitoring list.\n")
+	}
+}
+
+// debugCmdConnect connects to the node ID. It returns false if the node could not be found.
+// In JSON mode the result is written as jsonDebugConnect document after the connection attempt.
+func debugCmdConnect(backend *core.Backend, nodeID []byte, output commandOutput) (success bool) {
+	output.textf("---------------- Connect to node %s ----------------\n", hex.EncodeToString(nodeID))
+	defer output.textf("---------------- done node %s ----------------\n", hex.EncodeToString(nodeID))
+
+	result := jsonDebugConnect{NodeID: hex.EncodeToString(nodeID)}
+	if output.JSON {
+		defer func() { output.writeJSON(result) }()
+	}
 
 	// in local DHT list?
 	_, peer := backend.IsNodeContact(nodeID)
 	if peer != nil {
-		fmt.Fprintf(output, "* In local routing table: Yes.\n")
+		result.InRoutingTable = true
+		output.textf("* In local routing table: Yes.\n")
 	} else {
-		fmt.Fprintf(output, "* In local routing table: No. Lookup via DHT. Timeout = 10 seconds.\n")
+		output.textf("* In local routing table: No. Lookup via DHT. Timeout = 10 seconds.\n")
 
-		hashMonitorControl(nodeID, 0, output)
-		defer hashMonitorControl(nodeID, 1, nil)
+		// temporary subscription independent of any other monitoring of the node
+		monitorID := newMonitorSubscriber()
+		hashMonitorControl(nodeID, monitorID, 0, output)
+		defer hashMonitorRemoveAll(monitorID)
 
 		// Discovery via DHT.
 		_, peer, _ = backend.FindNode(nodeID, time.Second*10)
 		if peer == nil {
-			fmt.Fprintf(output, "* Not found via DHT :(\n")
-			return
+			output.textf("* Not found via DHT :(\n")
+			return false
 		}
 
-		fmt.Fprintf(output, "* Successfully discovered via DHT.\n")
+		output.textf("* Successfully discovered via DHT.\n")
 	}
 
-	fmt.Fprintf(output, "* Peer details:\n")
-	fmt.Fprintf(output, "  Uncontacted:      %t\n", peer.IsVirtual())
-	fmt.Fprintf(output, "  Root peer:        %t\n", peer.IsRootPeer)
-	fmt.Fprintf(output, "  User Agent:       %s\n", peer.UserAgent)
-	fmt.Fprintf(output, "  Firewall:         %t\n", peer.IsFirewallReported())
+	result.Found = true
+
+	output.textf("* Peer details:\n")
+	output.textf("  Uncontacted:      %t\n", peer.IsVirtual())
+	output.textf("  Root peer:        %t\n", peer.IsRootPeer)
+	output.textf("  User Agent:       %s\n", peer.UserAgent)
+	output.textf("  Firewall:         %t\n", peer.IsFirewallReported())
 
 	// virtual peer?
 	if peer.IsVirtual() {
-		fmt.Fprintf(output, "* Peer is virtual and was not contacted before. Sending out ping.\n")
+		output.textf("* Peer is virtual and was not contacted before. Sending out ping.\n")
 		peer.Ping()
+		result.Pinged = true
 	} else {
-		fmt.Fprintf(output, "* Connections:\n")
-		fmt.Fprintf(output, "%s", textPeerConnections(peer))
+		output.textf("* Connections:\n")
+		output.textf("%s", textPeerConnections(peer))
+	}
+
+	if output.JSON {
+		peerJSON := peerToJSON(peer, true)
+		result.Peer = &peerJSON
 	}
 
 	// ping via all connections TODO
 	//fmt.Fprintf(output, "* Sending ping:\n")
+
+	return true
 }
 
 // ---- filter for outgoing DHT searches ----
 
 // debug output of monitored keys searched in the DHT
 
-var monitorKeys map[string]io.Writer = make(map[string]io.Writer)
+// monitorKeys contains the subscribers of each monitored key. A key may have multiple subscribers, each with its own output.
+var monitorKeys = make(map[string]map[uint64]io.Writer)
 var monitorKeysMutex sync.RWMutex
+var monitorSubscriberLast uint64
+
+// newMonitorSubscriber returns a new unique subscriber ID. Each session uses its own subscriber ID.
+func newMonitorSubscriber() (subscriber uint64) {
+	return atomic.AddUint64(&monitorSubscriberLast, 1)
+}
 
-// hashMonitorControl adds (0), removes (1), or inverts (2) a hash on the list
-func hashMonitorControl(key []byte, action int, output io.Writer) (added bool) {
+// hashMonitorControl adds (0), removes (1), or inverts (2) the subscription of the subscriber to the hash.
+// Subscriptions of other subscribers to the same hash are not affected.
+func hashMonitorControl(key []byte, subscriber uint64, action int, output io.Writer) (added bool) {
 	monitorKeysMutex.Lock()
 	defer monitorKeysMutex.Unlock()
 
-	switch action {
-	case 0:
-		monitorKeys[string(key)] = output
+	subscribers := monitorKeys[string(key)]
+	_, exists := subscribers[subscriber]
+
+	switch {
+	case action == 0 || (action == 2 && !exists):
+		if subscribers == nil {
+			subscribers = make(map[uint64]io.Writer)
+			monitorKeys[string(key)] = subscribers
+		}
+		subscribers[subscriber] = output
 		added = true
-	case 1:
-		delete(monitorKeys, string(key))
-	case 2:
-		if _, ok := monitorKeys[string(key)]; !ok {
-			monitorKeys[string(key)] = output
-			added = true
-		} else {
+	case action == 1 || action == 2:
+		delete(subscribers, subscriber)
+		if len(subscribers) == 0 {
 			delete(monitorKeys, string(key))
 		}
 	}
@@ -94,22 +272,70 @@ func hashMonitorControl(key []byte, action int, output io.Writer) (added bool) {
 	return
 }
 
-func hashIsMonitored(keys ...[]byte) (monitored bool, output io.Writer) {
+// hashMonitorRemoveAll removes all subscriptions of the subscriber.
+func hashMonitorRemoveAll(subscriber uint64) {
 	monitorKeysMutex.Lock()
 	defer monitorKeysMutex.Unlock()
 
+	for key, subscribers := range monitorKeys {
+		delete(subscribers, subscriber)
+		if len(subscribers) == 0 {
+			delete(monitorKeys, key)
+		}
+	}
+}
+
+// hashIsMonitored checks if any of the keys is monitored. The returned output writes to all subscribers of the keys.
+func hashIsMonitored(keys ...[]byte) (monitored bool, output monitorOutput) {
+	monitorKeysMutex.RLock()
+	defer monitorKeysMutex.RUnlock()
+
+	var outputs monitorOutput
+	seen := make(map[uint64]struct{})
+
 	for _, key := range keys {
-		if output, monitored = monitorKeys[string(key)]; monitored {
-			return true, output
+		for subscriber, writer := range monitorKeys[string(key)] {
+			if _, ok := seen[subscriber]; !ok {
+				seen[subscriber] = struct{}{}
+				outputs = append(outputs, writer)
+			}
 		}
 	}
 
-	return false, nil
+	if len(outputs) == 0 {
+		return false, nil
+	}
+
+	return true, outputs
+}
+
+// monitorOutput writes to the outputs of multiple subscribers. Unlike io.MultiWriter, an error of one output does not affect the others.
+type monitorOutput []io.Writer
+
+func (outputs monitorOutput) Write(p []byte) (n int, err error) {
+	for _, output := range outputs {
+		output.Write(p)
+	}
+	return len(p), nil
+}
+
+// writeEvent writes the event as JSON document to subscribers in JSON mode, and the text to all other subscribers.
+// The output mode of a subscriber is the one at the time of subscription.
+func (outputs monitorOutput) writeEvent(text string, event *jsonMonitorEvent) {
+	for _, output := range outputs {
+		if commandOutput, ok := output.(commandOutput); ok && commandOutput.JSON {
+			commandOutput.writeJSON(event)
+		} else {
+			output.Write([]byte(text))
+		}
+	}
 }
 
 const keyMonitorAllSearches = "all searches" // special key to monitor all searches
 
 func filterSearchStatus(client *dht.SearchClient, function, format string, v ...interface{}) {
+	metricsCountSearchStatus(function)
+
 	monitored, output := hashIsMonitored(client.Key, []byte(keyMonitorAllSearches))
 	if !monitored {
 		return
@@ -131,7 +357,8 @@ func filterSearchStatus(client *dht.SearchClient, function, format string, v ...
 		intend = "  >"
 	}
 
-	fmt.Fprintf(output, intend+" "+function+" ["+hex.EncodeToString(keyA)+"] "+format, v...)
+	message := fmt.Sprintf(format, v...)
+	output.writeEvent(intend+" "+function+" ["+hex.EncodeToString(keyA)+"] "+message, &jsonMonitorEvent{Event: "search", Key: hex.EncodeToString(client.Key), Function: function, Text: strings.TrimSpace(message)})
 }
 
 // ---- filter for incoming information requests ----
@@ -156,10 +383,12 @@ func filterIncomingRequest(peer *core.PeerInfo, Action int, Key []byte, Info int
 		requestType = "INFO_STORE"
 	}
 
+	event := &jsonMonitorEvent{Event: "request", NodeID: hex.EncodeToString(peer.NodeID), Key: hex.EncodeToString(Key), Type: requestType}
+
 	if Action == protocol.ActionFindSelf && bytes.Equal(peer.NodeID, Key) {
-		fmt.Fprintf(output, "Info request from %s %s\n", hex.EncodeToString(peer.NodeID), requestType)
+		output.writeEvent(fmt.Sprintf("Info request from %s %s\n", hex.EncodeToString(peer.NodeID), requestType), event)
 	} else {
-		fmt.Fprintf(output, "Info request from %s %s for key %s\n", hex.EncodeToString(peer.NodeID), requestType, hex.EncodeToString(Key))
+		output.writeEvent(fmt.Sprintf("Info request from %s %s for key %s\n", hex.EncodeToString(peer.NodeID), requestType, hex.EncodeToString(Key)), event)
 	}
 }
 
@@ -191,8 +420,8 @@ func filterMessageIn(peer *core.PeerInfo, raw *protocol.MessageRaw, message inte
 		commandA = "Chat"
 	}
 
-	text := fmt.Sprintf("-------- Node %s Incoming %s --------\n", hex.EncodeToString(peer.NodeID), commandA)
-	text += fmt.Sprintf("Sender Peer ID: %s\n", hex.EncodeToString(peer.PublicKey.SerializeCompressed()))
+	header := fmt.Sprintf("-------- Node %s Incoming %s --------\n", hex.EncodeToString(peer.NodeID), commandA)
+	text := fmt.Sprintf("Sender Peer ID: %s\n", hex.EncodeToString(peer.PublicKey.SerializeCompressed()))
 
 	if !raw.SenderPublicKey.IsEqual(peer.PublicKey) {
 		text += fmt.Sprintf("WARNING: Mismatch of public keys, sender %s and packet indicates %s\n", hex.EncodeToString(peer.PublicKey.SerializeCompressed()), hex.EncodeToString(raw.SenderPublicKey.SerializeCompressed()))
@@ -270,9 +499,7 @@ func filterMessageIn(peer *core.PeerInfo, raw *protocol.MessageRaw, message inte
 		text += fmt.Sprintf("  Port IPv6 Reported External     %d\n", traverse.PortIPv6ReportedExternal)
 	}
 
-	text += "--------\n"
-
-	output.Write([]byte(text))
+	output.writeEvent(header+text+"--------\n", &jsonMonitorEvent{Event: "packetin", NodeID: hex.EncodeToString(peer.NodeID), Type: commandA, Text: text})
 }
 
 func outputPeerRecord(record *protocol.PeerRecord) (output string) {
@@ -321,14 +548,12 @@ func outputOutgoingMessage(peer *core.PeerInfo, packet *protocol.PacketRaw) {
 		commandA = "Chat"
 	}
 
-	text := fmt.Sprintf("-------- Node %s Outgoing %s --------\n", hex.EncodeToString(peer.NodeID), commandA)
-	text += fmt.Sprintf("Receiver Peer ID: %s\n", hex.EncodeToString(peer.PublicKey.SerializeCompressed()))
+	header := fmt.Sprintf("-------- Node %s Outgoing %s --------\n", hex.EncodeToString(peer.NodeID), commandA)
+	text := fmt.Sprintf("Receiver Peer ID: %s\n", hex.EncodeToString(peer.PublicKey.SerializeCompressed()))
 
 	// TODO: Decoding of payload data (done by caller of this function)
 
-	text += "--------\n"
-
-	output.Write([]byte(text))
+	output.writeEvent(header+text+"--------\n", &jsonMonitorEvent{Event: "packetout", NodeID: hex.EncodeToString(peer.NodeID), Type: commandA, Text: text})
 }
 
 func filterMessageOutAnnouncement(receiverPublicKey *btcec.PublicKey, peer *core.PeerInfo, packet *protocol.PacketRaw, findSelf bool, findPeer []protocol.KeyHash, findValue []protocol.KeyHash, files []protocol.InfoStore) {
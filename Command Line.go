@@ -8,620 +8,472 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/PeernetOfficial/core"
-	"github.com/PeernetOfficial/core/btcec"
-	"github.com/PeernetOfficial/core/dht"
 	"github.com/PeernetOfficial/core/protocol"
-	"github.com/PeernetOfficial/core/webapi"
 )
 
-func showHelp(output io.Writer) {
-	fmt.Fprint(output, "Please enter a command:\n"+
-		"help                          Show this help\n"+
-		"net list                      Lists all network adapters and their IPs\n"+
-		"status                        Get current status\n"+
-		"chat                          Send text to all peers\n"+
-		"peer list                     List current peers\n"+
-		"debug key create              Create Public-Private Key pair\n"+
-		"debug key self                List current Public-Private Key pair\n"+
-		"debug connect                 Attempts to connect to the target peer\n"+
-		"debug watch searches          Watch all outgoing DHT searches\n"+
-		"debug watch incoming          Watch all incoming information requests\n"+
-		"debug watch                   Watch packets and info requests for hash\n"+
-		"probe file transfer           Attempts to transfer and validate a remote file against a local file\n"+
-		"hash                          Create blake3 hash of input\n"+
-		"warehouse get                 Get data from local warehouse by hash\n"+
-		"warehouse store               Store data into local warehouse\n"+
-		"dht get                       Get data via DHT by hash\n"+
-		"dht store                     Store data into DHT\n"+
-		"get block                     Get block from remote peer\n"+
-		"log error                     Set error log output\n"+
-		"exit                          Exit\n"+
-		"search file                   Search globally for files using the local search index\n"+
-		"transfer list                 List of transfers\n"+
-		"\n")
+func init() {
+	registerCommand(&command{Name: "help", Aliases: []string{"?"}, Help: "Show this help", Handler: cmdHelp})
+	registerCommand(&command{Name: "net list", Help: "Lists all network adapters and their IPs", Handler: cmdNetList})
+	registerCommand(&command{Name: "status", Help: "Get current status", Handler: cmdStatus})
+	registerCommand(&command{Name: "chat", Aliases: []string{"chat all"}, Args: []commandArgument{{Name: "text", Rest: true}}, Help: "Send text to all peers", Handler: cmdChat})
+	registerCommand(&command{Name: "peer list", Help: "List current peers", Handler: cmdPeerList})
+	registerCommand(&command{Name: "hash", Args: []commandArgument{{Name: "text", Rest: true}}, Help: "Create blake3 hash of input", Handler: cmdHash})
+	registerCommand(&command{Name: "warehouse get", Args: []commandArgument{{Name: "hash"}}, Help: "Get data from local warehouse by hash", Handler: cmdWarehouseGet})
+	registerCommand(&command{Name: "warehouse store", Args: []commandArgument{{Name: "text", Rest: true}}, Help: "Store data into local warehouse", Handler: cmdWarehouseStore})
+	registerCommand(&command{Name: "dht get", Args: []commandArgument{{Name: "hash"}}, Help: "Get data via DHT by hash", Handler: cmdDHTGet})
+	registerCommand(&command{Name: "dht store", Args: []commandArgument{{Name: "text", Rest: true}}, Help: "Store data into DHT", Handler: cmdDHTStore})
+	registerCommand(&command{Name: "log error", Help: "Set error log output", Handler: cmdLogError,
+		Args: []commandArgument{{Name: "target", Prompt: "Please choose the target output of error messages:\n0 = Log file (default)\n1 = Command line\n2 = Log file + command line\n3 = None"}}})
+	registerCommand(&command{Name: "exit", Help: "Exit", Handler: cmdExit, Admin: true})
+	registerCommand(&command{Name: "search file", Args: []commandArgument{{Name: "text", Rest: true}}, Help: "Search globally for files using the local search index", Handler: cmdSearchFile})
+	registerCommand(&command{Name: "transfer list", Help: "List of transfers", Handler: cmdTransferList})
 }
 
-func userCommands(backend *core.Backend, input io.Reader, output io.Writer, terminateSignal chan struct{}) {
-	reader := bufio.NewReader(input)
-	monitoredHashes := make(map[string]struct{})
+// userCommands reads commands line by line from the input and executes them as soon as they arrive.
+// It returns when the input channel is closed or the context is cancelled, for example when the user disconnects.
+// If outputJSON is set, the results of commands are written as JSON documents instead of text.
+func userCommands(ctx context.Context, backend *core.Backend, input <-chan string, output io.Writer, outputJSON bool) {
+	session := newCommandSession(ctx, backend, input, output, outputJSON)
+	defer session.close()
 
-	defer func() { // unmonitor hashes in case of terminate signal
-		for hash := range monitoredHashes {
-			hashMonitorControl([]byte(hash), 1, nil)
-		}
-	}()
-
-	fmt.Fprint(output, appName+" "+core.Version+"\n------------------------------\n")
-	showHelp(output)
+	if !outputJSON {
+		fmt.Fprint(output, appName+" "+core.Version+"\n------------------------------\n")
+		showHelp(session.output)
+	}
 
 	for {
-		command, _, terminate := getUserOptionString(reader, terminateSignal)
+		text, _, terminate := getUserOptionString(ctx, input)
 		if terminate {
 			return
 		}
 
-		command = strings.ToLower(command)
-
-		switch command {
-		case "help", "?":
-			showHelp(output)
-
-		case "net list":
-			fmt.Fprint(output, NetworkListOutput())
-
-		case "debug key create":
-			privateKey, publicKey, err := core.Secp256k1NewPrivateKey()
-			if err != nil {
-				fmt.Fprintf(output, "Error: %s\n", err.Error())
-				return
-			}
+		session.execute(text)
+	}
+}
 
-			fmt.Fprintf(output, "Private Key: %s\n", hex.EncodeToString(privateKey.Serialize()))
-			fmt.Fprintf(output, "Public Key:  %s\n", hex.EncodeToString(publicKey.SerializeCompressed()))
+func cmdHelp(session *commandSession) {
+	showHelp(session.output)
+}
 
-		case "debug key self":
-			privateKey, publicKey := backend.ExportPrivateKey()
-			fmt.Fprintf(output, "Private Key: %s\n", hex.EncodeToString(privateKey.Serialize()))
-			fmt.Fprintf(output, "Public Key:  %s\n", hex.EncodeToString(publicKey.SerializeCompressed()))
+func cmdNetList(session *commandSession) {
+	if !session.output.JSON {
+		fmt.Fprint(session.output, NetworkListOutput())
+		return
+	}
 
-		case "peer list":
-			for _, peer := range GetPeerlistSorted(backend) {
-				info := ""
-				if peer.IsRootPeer {
-					info = " [root peer]"
-				}
-				if peer.IsBehindNAT() {
-					info += " [NAT]"
-				}
-				userAgent := strings.ToValidUTF8(peer.UserAgent, "?")
+	interfaces, err := networkListToJSON()
+	if err != nil {
+		session.errorf("Error %s\n", err.Error())
+		return
+	}
+	for _, info := range interfaces {
+		session.output.writeJSON(info)
+	}
+}
 
-				fmt.Fprintf(output, "* Peer ID %s%s\n  Node ID %s\n  User Agent: %s\n  Blockchain: height %d, version %d\n\n%s\n  Packets sent:      %d\n  Packets received:  %d\n\n", hex.EncodeToString(peer.PublicKey.SerializeCompressed()), info, hex.EncodeToString(peer.NodeID), userAgent, peer.BlockchainHeight, peer.BlockchainVersion, textPeerConnections(peer), peer.StatsPacketSent, peer.StatsPacketReceived)
-			}
+func cmdPeerList(session *commandSession) {
+	for _, peer := range GetPeerlistSorted(session.backend) {
+		if session.output.JSON {
+			session.output.writeJSON(peerToJSON(peer, true))
+			continue
+		}
 
-		case "chat all", "chat":
-			if text, valid, terminate := getUserOptionString(reader, terminateSignal); valid {
-				backend.SendChatAll(text)
-			} else if terminate {
-				return
-			}
+		info := ""
+		if peer.IsRootPeer {
+			info = " [root peer]"
+		}
+		if peer.IsBehindNAT() {
+			info += " [NAT]"
+		}
+		userAgent := strings.ToValidUTF8(peer.UserAgent, "?")
 
-		case "status":
-			_, publicKey := backend.ExportPrivateKey()
-			nodeID := backend.SelfNodeID()
-			fmt.Fprintf(output, "----------------\nPublic Key: %s\nNode ID:    %s\n\n", hex.EncodeToString(publicKey.SerializeCompressed()), hex.EncodeToString(nodeID))
+		fmt.Fprintf(session.output, "* Peer ID %s%s\n  Node ID %s\n  User Agent: %s\n  Blockchain: height %d, version %d\n\n%s\n  Packets sent:      %d\n  Packets received:  %d\n\n", hex.EncodeToString(peer.PublicKey.SerializeCompressed()), info, hex.EncodeToString(peer.NodeID), userAgent, peer.BlockchainHeight, peer.BlockchainVersion, textPeerConnections(peer), peer.StatsPacketSent, peer.StatsPacketReceived)
+	}
+}
 
-			features := ""
-			featureSupport := backend.FeatureSupport()
-			if featureSupport&(1<<protocol.FeatureIPv4Listen) > 0 {
-				features = "IPv4"
-			}
-			if featureSupport&(1<<protocol.FeatureIPv6Listen) > 0 {
-				if len(features) > 0 {
-					features += ", "
-				}
-				features += "IPv6"
-			}
-			if featureSupport&(1<<protocol.FeatureFirewall) > 0 {
-				if len(features) > 0 {
-					features += ", "
-				}
-				features += "Firewall Reported"
-			}
+func cmdChat(session *commandSession) {
+	if text, valid, _ := session.argString(0); valid {
+		session.backend.SendChatAll(text)
+	}
+}
 
-			fmt.Fprintf(output, "User Agent: %s\nFeatures:   %s\n\n", backend.SelfUserAgent(), features)
+func cmdStatus(session *commandSession) {
+	backend, output := session.backend, session.output
 
-			fmt.Fprintf(output, "Listen Address                                  Multicast IP out                  External Address\n")
+	if output.JSON {
+		output.writeJSON(statusToJSON(backend))
+		return
+	}
 
-			for _, network := range backend.GetNetworks(4) {
-				address, _, broadcastIPv4, ipExternal, externalPort := network.GetListen()
+	_, publicKey := backend.ExportPrivateKey()
+	nodeID := backend.SelfNodeID()
+	fmt.Fprintf(output, "----------------\nPublic Key: %s\nNode ID:    %s\n\n", hex.EncodeToString(publicKey.SerializeCompressed()), hex.EncodeToString(nodeID))
 
-				broadcastIPsA := ""
-				for n, broadcastIP := range broadcastIPv4 {
-					if n > 0 {
-						broadcastIPsA += ", "
-					}
-					broadcastIPsA += broadcastIP.String()
-				}
+	features := ""
+	featureSupport := backend.FeatureSupport()
+	if featureSupport&(1<<protocol.FeatureIPv4Listen) > 0 {
+		features = "IPv4"
+	}
+	if featureSupport&(1<<protocol.FeatureIPv6Listen) > 0 {
+		if len(features) > 0 {
+			features += ", "
+		}
+		features += "IPv6"
+	}
+	if featureSupport&(1<<protocol.FeatureFirewall) > 0 {
+		if len(features) > 0 {
+			features += ", "
+		}
+		features += "Firewall Reported"
+	}
 
-				externalAddress := ""
+	fmt.Fprintf(output, "User Agent: %s\nFeatures:   %s\n\n", backend.SelfUserAgent(), features)
 
-				if ipExternal != nil && !ipExternal.IsUnspecified() || externalPort > 0 {
-					externalIPA := "[unknown]"
-					externalPortA := ""
-					if ipExternal != nil && !ipExternal.IsUnspecified() {
-						externalIPA = ipExternal.String()
-					}
-					if externalPort > 0 {
-						externalPortA = strconv.Itoa(int(externalPort))
-					}
+	fmt.Fprintf(output, "Listen Address                                  Multicast IP out                  External Address\n")
 
-					externalAddress = net.JoinHostPort(externalIPA, externalPortA)
-				}
+	for _, network := range backend.GetNetworks(4) {
+		address, _, broadcastIPv4, ipExternal, externalPort := network.GetListen()
 
-				fmt.Fprintf(output, "%-46s  %-32s  %s\n", address.String(), broadcastIPsA, externalAddress)
+		broadcastIPsA := ""
+		for n, broadcastIP := range broadcastIPv4 {
+			if n > 0 {
+				broadcastIPsA += ", "
 			}
-			for _, network := range backend.GetNetworks(6) {
-				address, multicastIP, _, _, externalPort := network.GetListen()
+			broadcastIPsA += broadcastIP.String()
+		}
 
-				externalPortA := ""
-				if externalPort > 0 {
-					externalPortA = strconv.Itoa(int(externalPort))
-				}
+		externalAddress := ""
 
-				fmt.Fprintf(output, "%-46s  %-31s  %s\n", address.String(), multicastIP.String(), externalPortA)
+		if ipExternal != nil && !ipExternal.IsUnspecified() || externalPort > 0 {
+			externalIPA := "[unknown]"
+			externalPortA := ""
+			if ipExternal != nil && !ipExternal.IsUnspecified() {
+				externalIPA = ipExternal.String()
 			}
-
-			fmt.Fprintf(output, "\nPeer ID                                                             Sent      Received  IP                                   Flags   RTT     \n")
-			for _, peer := range GetPeerlistSorted(backend) {
-				addressA := "N/A"
-				rttA := "N/A"
-				if connectionsActive := peer.GetConnections(true); len(connectionsActive) > 0 {
-					addressA = addressToA(connectionsActive[0].Address)
-				}
-				if rtt := peer.GetRTT(); rtt > 0 {
-					rttA = rtt.Round(time.Millisecond).String()
-				}
-				flagsA := ""
-				if peer.IsRootPeer {
-					flagsA = "R"
-				}
-				if peer.IsBehindNAT() {
-					flagsA += "N"
-				}
-				if peer.IsFirewallReported() {
-					flagsA += "F"
-				}
-				fmt.Fprintf(output, "%-66s  %-8d  %-8d  %-35s  %-6s  %-6s\n", hex.EncodeToString(peer.PublicKey.SerializeCompressed()), peer.StatsPacketSent, peer.StatsPacketReceived, addressA, flagsA, rttA)
+			if externalPort > 0 {
+				externalPortA = strconv.Itoa(int(externalPort))
 			}
 
-			fmt.Fprintf(output, "\n")
-
-		case "hash":
-			if text, valid, terminate := getUserOptionString(reader, terminateSignal); valid {
-				hash := core.Data2Hash([]byte(text))
-				fmt.Fprintf(output, "blake3 hash: %s\n", hex.EncodeToString(hash))
-			} else if terminate {
-				return
-			}
+			externalAddress = net.JoinHostPort(externalIPA, externalPortA)
+		}
 
-		case "warehouse get":
-			if hash, valid, terminate := getUserOptionHash(reader, terminateSignal); valid {
-				data, found := backend.GetDataLocal(hash)
-				if !found {
-					fmt.Fprintf(output, "Not found.\n")
-				} else {
-					fmt.Fprintf(output, "Data hex:    %s\n", hex.EncodeToString(data))
-					fmt.Fprintf(output, "Data string: %s\n", string(data))
-				}
-			} else if terminate {
-				return
-			} else {
-				fmt.Fprintf(output, "Invalid hash. Hex-encoded blake3 hash as input is required.\n")
-			}
+		fmt.Fprintf(output, "%-46s  %-32s  %s\n", address.String(), broadcastIPsA, externalAddress)
+	}
+	for _, network := range backend.GetNetworks(6) {
+		address, multicastIP, _, _, externalPort := network.GetListen()
 
-		case "warehouse store":
-			if text, valid, terminate := getUserOptionString(reader, terminateSignal); valid {
-				if err := backend.StoreDataLocal([]byte(text)); err != nil {
-					fmt.Fprintf(output, "Error storing data: %s\n", err.Error())
-					break
-				}
-				fmt.Fprintf(output, "Stored via hash: %s\n", hex.EncodeToString(core.Data2Hash([]byte(text))))
-			} else if terminate {
-				return
-			}
+		externalPortA := ""
+		if externalPort > 0 {
+			externalPortA = strconv.Itoa(int(externalPort))
+		}
 
-		case "dht store":
-			if text, valid, terminate := getUserOptionString(reader, terminateSignal); valid {
-				if err := backend.StoreDataDHT([]byte(text), 5); err != nil {
-					fmt.Fprintf(output, "Error storing data: %s\n", err.Error())
-					break
-				}
-				fmt.Fprintf(output, "Stored via hash: %s\n", hex.EncodeToString(core.Data2Hash([]byte(text))))
-			} else if terminate {
-				return
-			}
+		fmt.Fprintf(output, "%-46s  %-31s  %s\n", address.String(), multicastIP.String(), externalPortA)
+	}
 
-		case "dht get":
-			if hash, valid, terminate := getUserOptionHash(reader, terminateSignal); valid {
-				data, sender, found := backend.GetDataDHT(hash)
-				if !found {
-					fmt.Fprintf(output, "Not found.\n")
-				} else {
-					fmt.Fprintf(output, "\nSender:      %s\n", hex.EncodeToString(sender))
-					fmt.Fprintf(output, "Data hex:    %s\n", hex.EncodeToString(data))
-					fmt.Fprintf(output, "Data string: %s\n", string(data))
-				}
-			} else if terminate {
-				return
-			} else {
-				fmt.Fprintf(output, "Invalid hash. Hex-encoded blake3 hash as input is required.\n")
-			}
+	fmt.Fprintf(output, "\nPeer ID                                                             Sent      Received  IP                                   Flags   RTT     \n")
+	for _, peer := range GetPeerlistSorted(backend) {
+		addressA := "N/A"
+		rttA := "N/A"
+		if connectionsActive := peer.GetConnections(true); len(connectionsActive) > 0 {
+			addressA = addressToA(connectionsActive[0].Address)
+		}
+		if rtt := peer.GetRTT(); rtt > 0 {
+			rttA = rtt.Round(time.Millisecond).String()
+		}
+		flagsA := ""
+		if peer.IsRootPeer {
+			flagsA = "R"
+		}
+		if peer.IsBehindNAT() {
+			flagsA += "N"
+		}
+		if peer.IsFirewallReported() {
+			flagsA += "F"
+		}
+		fmt.Fprintf(output, "%-66s  %-8d  %-8d  %-35s  %-6s  %-6s\n", hex.EncodeToString(peer.PublicKey.SerializeCompressed()), peer.StatsPacketSent, peer.StatsPacketReceived, addressA, flagsA, rttA)
+	}
 
-		case "log error":
-			fmt.Fprintf(output, "Please choose the target output of error messages:\n0 = Log file (default)\n1 = Command line\n2 = Log file + command line\n3 = None\n")
-			if number, valid, terminate := getUserOptionInt(reader, terminateSignal); valid && number >= 0 && number <= 3 {
-				backend.Config.LogTarget = number
-			} else if terminate {
-				return
-			} else {
-				fmt.Fprintf(output, "Invalid option.\n")
-			}
+	fmt.Fprintf(output, "\n")
+}
 
-		case "debug connect":
-			fmt.Fprintf(output, "Please specify the target peer to connect to via DHT lookup, either by peer ID or node ID:\n")
-			text, valid, terminate := getUserOptionString(reader, terminateSignal)
-			if terminate {
-				return
-			} else if !valid || (len(text) != 66 && len(text) != 64) {
-				fmt.Fprintf(output, "Invalid peer ID or node ID. It must be hex-encoded and 66 (peer ID) or 64 characters (node ID) long.\n")
-				break
-			}
+func cmdHash(session *commandSession) {
+	if text, valid, _ := session.argString(0); valid {
+		hash := core.Data2Hash([]byte(text))
+		if session.output.JSON {
+			session.output.writeJSON(jsonHash{Hash: hex.EncodeToString(hash)})
+			return
+		}
+		fmt.Fprintf(session.output, "blake3 hash: %s\n", hex.EncodeToString(hash))
+	}
+}
 
-			// node ID is required
-			var nodeID []byte
-			var err error
+func cmdWarehouseGet(session *commandSession) {
+	hash, valid, terminate := session.argHash(0)
+	if terminate {
+		return
+	} else if !valid {
+		session.errorf("Invalid hash. Hex-encoded blake3 hash as input is required.\n")
+		return
+	}
 
-			if len(text) == 66 {
-				// Assume peer ID was supplied.
-				publicKeyB, err := hex.DecodeString(text)
-				if err != nil || len(publicKeyB) != 33 {
-					fmt.Fprintf(output, "Invalid peer ID encoding.\n")
-					break
-				}
+	data, found := session.backend.GetDataLocal(hash)
+	if !found {
+		session.errorf("Not found.\n")
+	} else if session.output.JSON {
+		session.output.writeJSON(jsonData{Hash: hex.EncodeToString(hash), Data: hex.EncodeToString(data)})
+	} else {
+		fmt.Fprintf(session.output, "Data hex:    %s\n", hex.EncodeToString(data))
+		fmt.Fprintf(session.output, "Data string: %s\n", string(data))
+	}
+}
 
-				publicKey, err := btcec.ParsePubKey(publicKeyB, btcec.S256())
-				if err != nil {
-					fmt.Fprintf(output, "Invalid peer ID (public key decoding failed).\n")
-					continue
-				}
+func cmdWarehouseStore(session *commandSession) {
+	if text, valid, _ := session.argString(0); valid {
+		if err := session.backend.StoreDataLocal([]byte(text)); err != nil {
+			session.errorf("Error storing data: %s\n", err.Error())
+			return
+		}
+		session.printStored([]byte(text))
+	}
+}
 
-				nodeID = protocol.PublicKey2NodeID(publicKey)
-			} else {
-				// Node ID was supplied.
-				if nodeID, err = hex.DecodeString(text); err != nil || len(nodeID) != 256/8 {
-					fmt.Fprintf(output, "Invalid node ID encoding.\n")
-					break
-				}
-			}
+func cmdDHTStore(session *commandSession) {
+	if text, valid, _ := session.argString(0); valid {
+		if err := session.backend.StoreDataDHT([]byte(text), 5); err != nil {
+			session.errorf("Error storing data: %s\n", err.Error())
+			return
+		}
+		session.printStored([]byte(text))
+	}
+}
 
-			// is self?
-			if bytes.Equal(nodeID, backend.SelfNodeID()) {
-				fmt.Fprintf(output, "Target node is self.\n")
-				break
-			}
+// printStored prints the hash of the stored data.
+func (session *commandSession) printStored(data []byte) {
+	hashA := hex.EncodeToString(core.Data2Hash(data))
 
-			debugCmdConnect(backend, nodeID, output)
+	if session.output.JSON {
+		session.output.writeJSON(jsonHash{Hash: hashA})
+		return
+	}
+	fmt.Fprintf(session.output, "Stored via hash: %s\n", hashA)
+}
 
-		case "debug watch searches":
-			fmt.Fprintf(output, "Enable (1) or disable (0) watching of all outgoing DHT searches?\n")
-			if number, valid, terminate := getUserOptionInt(reader, terminateSignal); valid && number >= 0 && number <= 1 {
-				if number == 1 {
-					hashMonitorControl([]byte(keyMonitorAllSearches), 0, output)
-					monitoredHashes[keyMonitorAllSearches] = struct{}{}
-				} else {
-					hashMonitorControl([]byte(keyMonitorAllSearches), 1, output)
-					delete(monitoredHashes, keyMonitorAllSearches)
-				}
-			} else if terminate {
-				return
-			} else {
-				fmt.Fprintf(output, "Invalid option.\n")
-			}
+func cmdDHTGet(session *commandSession) {
+	hash, valid, terminate := session.argHash(0)
+	if terminate {
+		return
+	} else if !valid {
+		session.errorf("Invalid hash. Hex-encoded blake3 hash as input is required.\n")
+		return
+	}
 
-		case "debug watch incoming":
-			fmt.Fprintf(output, "Enable (1) or disable (0) watching of all incoming information requests?\n")
-			if number, valid, terminate := getUserOptionInt(reader, terminateSignal); valid && number >= 0 && number <= 1 {
-				if number == 1 {
-					hashMonitorControl([]byte(keyMonitorAllRequests), 0, output)
-					monitoredHashes[keyMonitorAllRequests] = struct{}{}
-				} else {
-					hashMonitorControl([]byte(keyMonitorAllRequests), 1, output)
-					delete(monitoredHashes, keyMonitorAllRequests)
-				}
-			} else if terminate {
-				return
-			} else {
-				fmt.Fprintf(output, "Invalid option.\n")
-			}
+	data, sender, found := session.backend.GetDataDHT(hash)
+	if !found {
+		session.errorf("Not found.\n")
+	} else if session.output.JSON {
+		session.output.writeJSON(jsonData{Hash: hex.EncodeToString(hash), Sender: hex.EncodeToString(sender), Data: hex.EncodeToString(data)})
+	} else {
+		fmt.Fprintf(session.output, "\nSender:      %s\n", hex.EncodeToString(sender))
+		fmt.Fprintf(session.output, "Data hex:    %s\n", hex.EncodeToString(data))
+		fmt.Fprintf(session.output, "Data string: %s\n", string(data))
+	}
+}
 
-		case "debug bucket refresh":
-			fmt.Fprintf(output, "Disable (1) or enable (0) bucket refresh. This can be useful to disable bucket refresh when debugging outgoing DHT searches. (current setting: %t)\n", dht.DisableBucketRefresh)
-			if number, valid, terminate := getUserOptionInt(reader, terminateSignal); valid && number >= 0 && number <= 1 {
-				dht.DisableBucketRefresh = number == 1
-			} else if terminate {
-				return
-			} else {
-				fmt.Fprintf(output, "Invalid option.\n")
-			}
+func cmdLogError(session *commandSession) {
+	if number, valid, terminate := session.argInt(0); valid && number >= 0 && number <= 3 {
+		session.backend.Config.LogTarget = number
+	} else if !terminate {
+		session.errorf("Invalid option.\n")
+	}
+}
 
-		case "debug watch":
-			fmt.Fprintf(output, "Enter hash of data or node ID to watch. This monitors info requests and packets. Enter same hash again to remove from list.\n")
-			text, _, terminate := getUserOptionString(reader, terminateSignal)
-			if terminate {
-				return
-			}
-			var hash []byte
-			var err error
-			if hash, err = hex.DecodeString(text); err != nil || len(hash) != 256/8 {
-				fmt.Fprintf(output, "Invalid hash. Hex-encoded 64 character hash expected.\n")
-				break
-			}
+func cmdExit(session *commandSession) {
+	session.output.textf("Shutting down. Waiting for active transfers to complete.\n")
 
-			added := hashMonitorControl(hash, 2, output)
-			if added {
-				monitoredHashes[string(hash)] = struct{}{}
-				fmt.Fprintf(output, "The hash was added to the monitoring list.\n")
-			} else {
-				delete(monitoredHashes, string(hash))
-				fmt.Fprintf(output, "The hash was removed from the monitoring list.\n")
-			}
+	if !shutdownApplication(session.backend, "exit via user terminal command", false) {
+		session.errorf("Shutdown already in progress.\n")
+	}
+}
 
-		case "probe file transfer":
-			fmt.Fprintf(output, "Enter peer ID or node ID to connect:\n")
-			nodeIDA, _, terminate := getUserOptionString(reader, terminateSignal)
-			if terminate {
-				return
-			}
-			fmt.Fprintf(output, "Enter file hash:\n")
-			fileHashA, _, terminate := getUserOptionString(reader, terminateSignal)
-			if terminate {
-				return
-			}
+func cmdSearchFile(session *commandSession) {
+	text, _, terminate := session.argString(0)
+	if terminate {
+		return
+	}
 
-			fileHash, valid1 := webapi.DecodeBlake3Hash(fileHashA)
-			nodeID, valid2 := webapi.DecodeBlake3Hash(nodeIDA)
-			publicKey, err3 := core.PublicKeyFromPeerID(nodeIDA)
+	results := session.backend.SearchIndex.Search(text)
+	if len(results) == 0 {
+		if !session.output.JSON {
+			fmt.Fprintf(session.output, "No results found.\n")
+		}
+		return
+	}
 
-			if !valid2 && err3 != nil {
-				fmt.Fprintf(output, "Invalid peer ID or node ID.\n")
-				break
-			} else if !valid1 {
-				fmt.Fprintf(output, "Invalid file hash.\n")
+	for _, result := range results {
+		if session.output.JSON {
+			info := jsonSearchResult{FileID: result.FileID.String(), PublicKey: hex.EncodeToString(result.PublicKey.SerializeCompressed()), BlockNumber: result.BlockNumber, Keywords: []string{}}
+			for _, selector := range result.Selectors {
+				info.Keywords = append(info.Keywords, selector.Word)
 			}
+			session.output.writeJSON(info)
+			continue
+		}
 
-			var peer *core.PeerInfo
-			var err error
-			timeout := time.Second * 10
-
-			if valid2 {
-				peer, err = webapi.PeerConnectNode(backend, nodeID, timeout)
-			} else if err3 == nil {
-				peer, err = webapi.PeerConnectPublicKey(backend, publicKey, timeout)
-			}
-			if err != nil {
-				fmt.Fprintf(output, "Could not connect to peer: %s\n", err.Error())
-				break
+		fmt.Fprintf(session.output, "- File ID               %s\n", result.FileID.String())
+		fmt.Fprintf(session.output, "  Public Key            %s\n", hex.EncodeToString(result.PublicKey.SerializeCompressed()))
+		fmt.Fprintf(session.output, "  Block Number          %d\n", result.BlockNumber)
+		keywords := ""
+		for n, selector := range result.Selectors {
+			if n > 0 {
+				keywords += ", "
 			}
+			keywords += selector.Word
+		}
+		fmt.Fprintf(session.output, "  Found via keywords    %s\n", keywords)
+	}
+}
 
-			go transferCompareFile(peer, fileHash, output)
+func cmdTransferList(session *commandSession) {
+	var textF, textB string
+	output := session.output
 
-		case "get block":
-			fmt.Fprintf(output, "Enter peer ID or node ID:\n")
-			nodeIDA, _, terminate := getUserOptionString(reader, terminateSignal)
-			if terminate {
-				return
-			}
-			fmt.Fprintf(output, "Enter block number:\n")
-			blockNumber, _, terminate := getUserOptionInt(reader, terminateSignal)
-			if terminate {
-				return
-			}
+	if output.JSON {
+		for _, transfer := range transfersToJSON(session.backend) {
+			output.writeJSON(transfer)
+		}
+		return
+	}
 
-			nodeID, valid2 := webapi.DecodeBlake3Hash(nodeIDA)
-			publicKey, err3 := core.PublicKeyFromPeerID(nodeIDA)
+	for _, liteSession := range session.backend.LiteSessions() {
+		if virtualConn, ok := liteSession.Data.(*core.VirtualPacketConn); ok {
+			if fileStats, ok := virtualConn.Stats.(*core.FileTransferStats); ok {
+				var direction string
+				switch fileStats.Direction {
+				case core.DirectionIn:
+					direction = "In"
+				case core.DirectionOut:
+					direction = "Out"
+				case core.DirectionBi:
+					direction = "Bi"
+				}
 
-			if !valid2 && err3 != nil {
-				fmt.Fprintf(output, "Invalid peer ID or node ID.\n")
-				break
-			} else if blockNumber < 0 {
-				fmt.Fprintf(output, "Invalid block number.\n")
-			}
+				textF += fmt.Sprintf("%-12s  %-12s  %-12s  %-3s  %-10d %-10d %-8d",
+					shortenText(liteSession.ID.String(), 8), shortenText(hex.EncodeToString(virtualConn.Peer.PublicKey.SerializeCompressed()), 8), shortenText(hex.EncodeToString(fileStats.Hash), 8),
+					direction, fileStats.FileSize, fileStats.Offset, fileStats.Limit)
 
-			var peer *core.PeerInfo
-			var err error
-			timeout := time.Second * 10
+				if fileStats.UDTConn != nil {
+					metrics := fileStats.UDTConn.Metrics
 
-			if valid2 {
-				peer, err = webapi.PeerConnectNode(backend, nodeID, timeout)
-			} else if err3 == nil {
-				peer, err = webapi.PeerConnectPublicKey(backend, publicKey, timeout)
-			}
-			if err != nil {
-				fmt.Fprintf(output, "Could not connect to peer: %s\n", err.Error())
-				break
-			}
+					speed := "?"
+					percent := "?"
+					//eta := "?"
 
-			go blockTransfer(peer, uint64(blockNumber), output)
+					switch fileStats.Direction {
+					case core.DirectionIn:
+						speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedReceive/1024)
+						if fileStats.FileSize > 0 && metrics.DataReceived >= 16 {
+							percent = fmt.Sprintf("%.2f%%", float64((metrics.DataReceived-16)*100)/float64(fileStats.FileSize))
+						}
+					case core.DirectionOut:
+						speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedSend/1024)
+						if fileStats.FileSize > 0 && metrics.DataSent >= 16 {
+							percent = fmt.Sprintf("%.2f%%", float64((metrics.DataSent-16)*100)/float64(fileStats.FileSize))
+						}
+					case core.DirectionBi:
+						speed = fmt.Sprintf("%.2f KB/s - %.2f KB/s", metrics.SpeedSend/1024, metrics.SpeedReceive/1024)
+					}
 
-		case "exit":
-			backend.LogError("userCommands", "graceful exit via user terminal command\n")
-			os.Exit(core.ExitGraceful)
+					status := "Active"
+					if reason := virtualConn.GetTerminateReason(); reason > 0 {
+						status = "Terminated. " + translateTerminateReason(reason)
+					}
 
-		case "search file":
-			text, _, terminate := getUserOptionString(reader, terminateSignal)
-			if terminate {
-				return
-			}
+					started := metrics.Started.Format(dateFormat)
 
-			results := backend.SearchIndex.Search(text)
-			if len(results) == 0 {
-				fmt.Fprintf(output, "No results found.\n")
-				break
-			}
+					textF += fmt.Sprintf(" | %-12s  %-5s %-5s %-8s %-8s %-8s %-8s %-14s %-7s %s  %s\n",
+						formatTextNumbers2(metrics.DataSent, metrics.DataReceived), formatTextNumbers2(metrics.PktSendHandShake, metrics.PktRecvHandShake), formatTextNumbers2(metrics.PktSentShutdown, metrics.PktRecvShutdown),
+						formatTextNumbers2(metrics.PktSentACK, metrics.PktRecvACK), formatTextNumbers2(metrics.PktSentNAK, metrics.PktRecvNAK), formatTextNumbers2(metrics.PktSentACK2, metrics.PktRecvACK2), formatTextNumbers2(metrics.PktSentData, metrics.PktRecvData),
+						speed, percent, started, status)
+				} else {
+					textF += "  [UDT connection not established]\n"
+				}
+			} else if blockStats, ok := virtualConn.Stats.(*core.BlockTransferStats); ok {
+				var direction, targetBlocks string
+				switch blockStats.Direction {
+				case core.DirectionIn:
+					direction = "In"
+				case core.DirectionOut:
+					direction = "Out"
+				case core.DirectionBi:
+					direction = "Bi"
+				}
 
-			for _, result := range results {
-				fmt.Fprintf(output, "- File ID               %s\n", result.FileID.String())
-				fmt.Fprintf(output, "  Public Key            %s\n", hex.EncodeToString(result.PublicKey.SerializeCompressed()))
-				fmt.Fprintf(output, "  Block Number          %d\n", result.BlockNumber)
-				keywords := ""
-				for n, selector := range result.Selectors {
+				for n, block := range blockStats.TargetBlocks {
 					if n > 0 {
-						keywords += ", "
+						targetBlocks += ", "
 					}
-					keywords += selector.Word
+					targetBlocks += fmt.Sprintf("%d-%d", block.Offset, block.Limit)
 				}
-				fmt.Fprintf(output, "  Found via keywords    %s\n", keywords)
-			}
 
-		case "transfer list":
-			var textF, textB string
-
-			for _, session := range backend.LiteSessions() {
-				if virtualConn, ok := session.Data.(*core.VirtualPacketConn); ok {
-					if fileStats, ok := virtualConn.Stats.(*core.FileTransferStats); ok {
-						var direction string
-						switch fileStats.Direction {
-						case core.DirectionIn:
-							direction = "In"
-						case core.DirectionOut:
-							direction = "Out"
-						case core.DirectionBi:
-							direction = "Bi"
-						}
+				textB += fmt.Sprintf("%-12s  %-12s  %-12s  %-17s %-3s  %-12d %-15d",
+					shortenText(liteSession.ID.String(), 8), shortenText(hex.EncodeToString(virtualConn.Peer.PublicKey.SerializeCompressed()), 8), shortenText(hex.EncodeToString(blockStats.BlockchainPublicKey.SerializeCompressed()), 8),
+					targetBlocks, direction, blockStats.LimitBlockCount, blockStats.MaxBlockSize)
 
-						textF += fmt.Sprintf("%-12s  %-12s  %-12s  %-3s  %-10d %-10d %-8d",
-							shortenText(session.ID.String(), 8), shortenText(hex.EncodeToString(virtualConn.Peer.PublicKey.SerializeCompressed()), 8), shortenText(hex.EncodeToString(fileStats.Hash), 8),
-							direction, fileStats.FileSize, fileStats.Offset, fileStats.Limit)
-
-						if fileStats.UDTConn != nil {
-							metrics := fileStats.UDTConn.Metrics
-
-							speed := "?"
-							percent := "?"
-							//eta := "?"
-
-							switch fileStats.Direction {
-							case core.DirectionIn:
-								speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedReceive/1024)
-								if fileStats.FileSize > 0 && metrics.DataReceived >= 16 {
-									percent = fmt.Sprintf("%.2f%%", float64((metrics.DataReceived-16)*100)/float64(fileStats.FileSize))
-								}
-							case core.DirectionOut:
-								speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedSend/1024)
-								if fileStats.FileSize > 0 && metrics.DataSent >= 16 {
-									percent = fmt.Sprintf("%.2f%%", float64((metrics.DataSent-16)*100)/float64(fileStats.FileSize))
-								}
-							case core.DirectionBi:
-								speed = fmt.Sprintf("%.2f KB/s - %.2f KB/s", metrics.SpeedSend/1024, metrics.SpeedReceive/1024)
-							}
-
-							status := "Active"
-							if reason := virtualConn.GetTerminateReason(); reason > 0 {
-								status = "Terminated. " + translateTerminateReason(reason)
-							}
-
-							started := metrics.Started.Format(dateFormat)
-
-							textF += fmt.Sprintf(" | %-12s  %-5s %-5s %-8s %-8s %-8s %-8s %-14s %-7s %s  %s\n",
-								formatTextNumbers2(metrics.DataSent, metrics.DataReceived), formatTextNumbers2(metrics.PktSendHandShake, metrics.PktRecvHandShake), formatTextNumbers2(metrics.PktSentShutdown, metrics.PktRecvShutdown),
-								formatTextNumbers2(metrics.PktSentACK, metrics.PktRecvACK), formatTextNumbers2(metrics.PktSentNAK, metrics.PktRecvNAK), formatTextNumbers2(metrics.PktSentACK2, metrics.PktRecvACK2), formatTextNumbers2(metrics.PktSentData, metrics.PktRecvData),
-								speed, percent, started, status)
-						} else {
-							textF += "  [UDT connection not established]\n"
-						}
-					} else if blockStats, ok := virtualConn.Stats.(*core.BlockTransferStats); ok {
-						var direction, targetBlocks string
-						switch blockStats.Direction {
-						case core.DirectionIn:
-							direction = "In"
-						case core.DirectionOut:
-							direction = "Out"
-						case core.DirectionBi:
-							direction = "Bi"
-						}
+				if blockStats.UDTConn != nil {
+					metrics := blockStats.UDTConn.Metrics
 
-						for n, block := range blockStats.TargetBlocks {
-							if n > 0 {
-								targetBlocks += ", "
-							}
-							targetBlocks += fmt.Sprintf("%d-%d", block.Offset, block.Limit)
-						}
+					speed := "?"
+					percent := ""
+					//eta := "?"
 
-						textB += fmt.Sprintf("%-12s  %-12s  %-12s  %-17s %-3s  %-12d %-15d",
-							shortenText(session.ID.String(), 8), shortenText(hex.EncodeToString(virtualConn.Peer.PublicKey.SerializeCompressed()), 8), shortenText(hex.EncodeToString(blockStats.BlockchainPublicKey.SerializeCompressed()), 8),
-							targetBlocks, direction, blockStats.LimitBlockCount, blockStats.MaxBlockSize)
-
-						if blockStats.UDTConn != nil {
-							metrics := blockStats.UDTConn.Metrics
-
-							speed := "?"
-							percent := ""
-							//eta := "?"
-
-							switch blockStats.Direction {
-							case core.DirectionIn:
-								speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedReceive/1024)
-							case core.DirectionOut:
-								speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedSend/1024)
-							case core.DirectionBi:
-								speed = fmt.Sprintf("%.2f KB/s - %.2f KB/s", metrics.SpeedSend/1024, metrics.SpeedReceive/1024)
-							}
-
-							status := "Active"
-							if reason := virtualConn.GetTerminateReason(); reason > 0 {
-								status = "Terminated. " + translateTerminateReason(reason)
-							}
-
-							started := metrics.Started.Format(dateFormat)
-
-							textB += fmt.Sprintf(" | %-12s  %-5s %-5s %-8s %-8s %-8s %-8s %-14s %-7s %s  %s\n",
-								formatTextNumbers2(metrics.DataSent, metrics.DataReceived), formatTextNumbers2(metrics.PktSendHandShake, metrics.PktRecvHandShake), formatTextNumbers2(metrics.PktSentShutdown, metrics.PktRecvShutdown),
-								formatTextNumbers2(metrics.PktSentACK, metrics.PktRecvACK), formatTextNumbers2(metrics.PktSentNAK, metrics.PktRecvNAK), formatTextNumbers2(metrics.PktSentACK2, metrics.PktRecvACK2), formatTextNumbers2(metrics.PktSentData, metrics.PktRecvData),
-								speed, percent, started, status)
-						} else {
-							textB += "  [UDT connection not established]\n"
-						}
+					switch blockStats.Direction {
+					case core.DirectionIn:
+						speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedReceive/1024)
+					case core.DirectionOut:
+						speed = fmt.Sprintf("%.2f KB/s", metrics.SpeedSend/1024)
+					case core.DirectionBi:
+						speed = fmt.Sprintf("%.2f KB/s - %.2f KB/s", metrics.SpeedSend/1024, metrics.SpeedReceive/1024)
+					}
 
+					status := "Active"
+					if reason := virtualConn.GetTerminateReason(); reason > 0 {
+						status = "Terminated. " + translateTerminateReason(reason)
 					}
+
+					started := metrics.Started.Format(dateFormat)
+
+					textB += fmt.Sprintf(" | %-12s  %-5s %-5s %-8s %-8s %-8s %-8s %-14s %-7s %s  %s\n",
+						formatTextNumbers2(metrics.DataSent, metrics.DataReceived), formatTextNumbers2(metrics.PktSendHandShake, metrics.PktRecvHandShake), formatTextNumbers2(metrics.PktSentShutdown, metrics.PktRecvShutdown),
+						formatTextNumbers2(metrics.PktSentACK, metrics.PktRecvACK), formatTextNumbers2(metrics.PktSentNAK, metrics.PktRecvNAK), formatTextNumbers2(metrics.PktSentACK2, metrics.PktRecvACK2), formatTextNumbers2(metrics.PktSentData, metrics.PktRecvData),
+						speed, percent, started, status)
+				} else {
+					textB += "  [UDT connection not established]\n"
 				}
-			}
 
-			if textF != "" {
-				fmt.Fprintf(output, "Lite ID       Peer          Hash          Way  File Size  Offset     Limit    | Write-Read    HS    Shut  ACK      NAK      ACK2     Data     Speed          %%       Started              Status\n%s", textF)
-			}
-			if textB != "" {
-				fmt.Fprintf(output, "Lite ID       Peer          Blockchain    Target Blocks     Way  Limit Count  Max Block Size  | Write-Read    HS    Shut  ACK      NAK      ACK2     Data     Speed          %%       Started              Status\n%s", textB)
 			}
+		}
+	}
 
-			if textF == "" && textB == "" {
-				fmt.Fprintf(output, "No transfers.\n")
-			}
+	if textF != "" {
+		fmt.Fprintf(output, "Lite ID       Peer          Hash          Way  File Size  Offset     Limit    | Write-Read    HS    Shut  ACK      NAK      ACK2     Data     Speed          %%       Started              Status\n%s", textF)
+	}
+	if textB != "" {
+		fmt.Fprintf(output, "Lite ID       Peer          Blockchain    Target Blocks     Way  Limit Count  Max Block Size  | Write-Read    HS    Shut  ACK      NAK      ACK2     Data     Speed          %%       Started              Status\n%s", textB)
+	}
 
-		default:
-			fmt.Fprintf(output, "Unknown command.\n")
-		}
+	if textF == "" && textB == "" {
+		fmt.Fprintf(output, "No transfers.\n")
 	}
 }
 
@@ -790,34 +642,53 @@ func GetPeerlistSorted(backend *core.Backend) (peers []*core.PeerInfo) {
 
 // ---- command-line helper functions ----
 
-// timeRetryUserInput defines how long the code waits for user input from reader before trying again
-// The termination signal takes effect once the reader is drained and returns io.EOF.
-const timeRetryUserInput = 500 * time.Millisecond
-
-// readUserText reads user text from the buffer. Blocking, unless termination signal is raised!
-func readUserText(reader *bufio.Reader, terminateSignal <-chan struct{}) (text string, valid, terminate bool) {
-	for {
-		if text, err := reader.ReadString('\n'); err == nil {
-			return strings.TrimSpace(text), true, false
+// readLines reads the input line by line and sends each line to the returned channel.
+// The channel is closed at the end of the input, on read error, or when the context is cancelled.
+func readLines(ctx context.Context, input io.Reader) <-chan string {
+	lines := make(chan string)
+
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(input)
+
+		for {
+			text, err := reader.ReadString('\n')
+			if err == nil || text != "" { // the last line may not be terminated
+				select {
+				case lines <- text:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
 		}
+	}()
+
+	return lines
+}
 
-		// check for termination signal
-		select {
-		case <-terminateSignal:
+// readUserText reads the next line of user text. It blocks until a line arrives, the input is closed, or the context is cancelled.
+func readUserText(ctx context.Context, input <-chan string) (text string, valid, terminate bool) {
+	select {
+	case text, ok := <-input:
+		if !ok {
 			return "", false, true
-		default:
 		}
+		return strings.TrimSpace(text), true, false
 
-		time.Sleep(timeRetryUserInput)
+	case <-ctx.Done():
+		return "", false, true
 	}
 }
 
-func getUserOptionString(reader *bufio.Reader, terminateSignal <-chan struct{}) (response string, valid, terminate bool) {
-	return readUserText(reader, terminateSignal)
+func getUserOptionString(ctx context.Context, input <-chan string) (response string, valid, terminate bool) {
+	return readUserText(ctx, input)
 }
 
-func getUserOptionBool(reader *bufio.Reader, terminateSignal <-chan struct{}) (response bool, valid, terminate bool) {
-	responseA, valid, terminate := readUserText(reader, terminateSignal)
+func getUserOptionBool(ctx context.Context, input <-chan string) (response bool, valid, terminate bool) {
+	responseA, valid, terminate := readUserText(ctx, input)
 	if !valid || terminate {
 		return false, valid, terminate
 	}
@@ -830,8 +701,8 @@ func getUserOptionBool(reader *bufio.Reader, terminateSignal <-chan struct{}) (r
 	return responseI == 1, true, false
 }
 
-func getUserOptionInt(reader *bufio.Reader, terminateSignal <-chan struct{}) (response int, valid, terminate bool) {
-	responseA, valid, terminate := readUserText(reader, terminateSignal)
+func getUserOptionInt(ctx context.Context, input <-chan string) (response int, valid, terminate bool) {
+	responseA, valid, terminate := readUserText(ctx, input)
 	if !valid || terminate {
 		return 0, valid, terminate
 	}
@@ -844,8 +715,8 @@ func getUserOptionInt(reader *bufio.Reader, terminateSignal <-chan struct{}) (re
 	return responseI, true, false
 }
 
-func getUserOptionHash(reader *bufio.Reader, terminateSignal <-chan struct{}) (hash []byte, valid, terminate bool) {
-	responseA, valid, terminate := readUserText(reader, terminateSignal)
+func getUserOptionHash(ctx context.Context, input <-chan string) (hash []byte, valid, terminate bool) {
+	responseA, valid, terminate := readUserText(ctx, input)
 	if !valid || terminate {
 		return nil, valid, terminate
 	}
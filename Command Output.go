@@ -0,0 +1,512 @@
+/*
+File Name:  Command Output.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Machine-readable JSON output of commands. In JSON mode each result is written as a single JSON document terminated by a new line.
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/PeernetOfficial/core/protocol"
+	"github.com/PeernetOfficial/core/udt"
+)
+
+func init() {
+	registerCommand(&command{Name: "output", Help: "Set the output format of this session", Handler: cmdOutput,
+		Args: []commandArgument{{Name: "json|text", Prompt: "Enter the output format (json or text):"}}})
+}
+
+// commandOutput is the output of a session. It writes results either as text or JSON.
+type commandOutput struct {
+	io.Writer
+	JSON bool // Whether results are written as JSON documents.
+}
+
+// errorWriter is implemented by writers that handle error messages separately from regular output.
+type errorWriter interface {
+	writeError(message string)
+}
+
+// errorf writes the error message either as text, or as JSON document with the error field.
+// If the writer implements errorWriter, the error message is passed to it instead.
+func (output commandOutput) errorf(format string, v ...interface{}) {
+	if writer, ok := output.Writer.(errorWriter); ok {
+		writer.writeError(strings.TrimSpace(fmt.Sprintf(format, v...)))
+		return
+	} else if !output.JSON {
+		fmt.Fprintf(output, format, v...)
+		return
+	}
+
+	output.writeJSON(&jsonError{Error: strings.TrimSpace(fmt.Sprintf(format, v...))})
+}
+
+// writeJSON writes the data as single JSON document terminated by a new line.
+func (output commandOutput) writeJSON(data interface{}) {
+	response, err := json.Marshal(data)
+	if err != nil {
+		response, _ = json.Marshal(&jsonError{Error: "Error encoding JSON: " + err.Error()})
+	}
+
+	output.Write(append(response, '\n'))
+}
+
+// textf writes the text only in text mode. It is used for progress information that is reported as JSON document in JSON mode.
+func (output commandOutput) textf(format string, v ...interface{}) {
+	if !output.JSON {
+		fmt.Fprintf(output, format, v...)
+	}
+}
+
+func cmdOutput(session *commandSession) {
+	format, _, terminate := session.argString(0)
+	if terminate {
+		return
+	}
+
+	switch strings.ToLower(format) {
+	case "json":
+		session.output.JSON = true
+	case "text":
+		session.output.JSON = false
+	default:
+		session.errorf("Invalid output format. Use json or text.\n")
+	}
+}
+
+type jsonError struct {
+	Error string `json:"error"` // Error message.
+}
+
+type jsonPrompt struct {
+	Prompt string `json:"prompt"` // Prompt for the missing argument. The next input line is used as argument.
+}
+
+type jsonCommand struct {
+	Name      string   `json:"name"`      // Name of the command.
+	Aliases   []string `json:"aliases"`   // Alternative names.
+	Arguments []string `json:"arguments"` // Names of the arguments.
+	Help      string   `json:"help"`      // Help text.
+}
+
+type jsonInterface struct {
+	Name string   `json:"name"`            // Name of the network interface.
+	IPs  []string `json:"ips"`             // IP addresses of the interface.
+	Err  string   `json:"error,omitempty"` // Error getting the addresses, if any.
+}
+
+type jsonHash struct {
+	Hash string `json:"hash"` // Hex-encoded blake3 hash.
+}
+
+type jsonData struct {
+	Hash   string `json:"hash"`             // Hex-encoded blake3 hash of the data.
+	Sender string `json:"sender,omitempty"` // Node ID of the peer that provided the data. Empty if local.
+	Data   string `json:"data"`             // Hex-encoded data.
+}
+
+type jsonBucketRefresh struct {
+	Disabled bool `json:"disabled"` // Whether the DHT bucket refresh is disabled.
+}
+
+type jsonMonitor struct {
+	Key       string `json:"key"`       // Hex-encoded hash or node ID.
+	Monitored bool   `json:"monitored"` // Whether the key is monitored by this session after the command.
+}
+
+type jsonMonitorEvent struct {
+	Event    string `json:"event"`              // Type of the event: search, request, packetin, packetout.
+	NodeID   string `json:"nodeid,omitempty"`   // Node ID of the remote peer.
+	Key      string `json:"key,omitempty"`      // Hex-encoded key of the search or information request.
+	Function string `json:"function,omitempty"` // Search only: Function that reported the status.
+	Type     string `json:"type,omitempty"`     // Type of the information request or command of the packet.
+	Text     string `json:"text,omitempty"`     // Details as text.
+}
+
+type jsonDebugConnect struct {
+	NodeID         string    `json:"nodeid"`         // Node ID of the target peer.
+	InRoutingTable bool      `json:"inroutingtable"` // Whether the peer was in the local routing table. Otherwise it was looked up via DHT.
+	Found          bool      `json:"found"`          // Whether the peer was found.
+	Pinged         bool      `json:"pinged"`         // Whether a ping was sent because the peer was not contacted before.
+	Peer           *jsonPeer `json:"peer,omitempty"` // Peer details including the connections. Nil if not found.
+}
+
+type jsonProbeStatus struct {
+	Status   string  `json:"status"`             // Stage of the transfer: connected, opened, progress.
+	NodeID   string  `json:"nodeid,omitempty"`   // Connected: Node ID of the remote peer.
+	FileHash string  `json:"filehash,omitempty"` // Opened: Hash of the file.
+	FileSize uint64  `json:"filesize,omitempty"` // Opened: File size.
+	Offset   int     `json:"offset,omitempty"`   // Progress: Offset in the file.
+	Progress float64 `json:"progress,omitempty"` // Progress: Progress in percent.
+	Speed    float64 `json:"speed,omitempty"`    // Progress: Speed in KB/s since the last progress.
+}
+
+type jsonProbeResult struct {
+	FileHash            string          `json:"filehash"`                 // Hash of the file.
+	FileSize            uint64          `json:"filesize"`                 // File size.
+	Transferred         int             `json:"transferred"`              // Bytes received.
+	Matching            bool            `json:"matching"`                 // Whether the transfer is complete and all data matches the local file.
+	Error               string          `json:"error,omitempty"`          // Error reading from the remote peer or the local warehouse. Empty if none.
+	MismatchOffset      int             `json:"mismatchoffset,omitempty"` // Offset of the data that does not match the local file.
+	MismatchRemote      string          `json:"mismatchremote,omitempty"` // Hex-encoded data from the remote peer that does not match.
+	MismatchLocal       string          `json:"mismatchlocal,omitempty"`  // Hex-encoded data from the local warehouse.
+	TerminateReason     int             `json:"terminatereason"`          // Terminate reason of the virtual connection.
+	TerminateReasonText string          `json:"terminatereasontext"`      // Description of the terminate reason.
+	Duration            float64         `json:"duration"`                 // Duration of the transfer in seconds.
+	Speed               float64         `json:"speed"`                    // Average speed in KB/s.
+	Metrics             *jsonUDTMetrics `json:"metrics"`                  // UDT metrics.
+}
+
+type jsonKeyPair struct {
+	PrivateKey string `json:"privatekey"` // Hex-encoded private key.
+	PublicKey  string `json:"publickey"`  // Hex-encoded compressed public key. This is the peer ID.
+}
+
+type jsonSearchResult struct {
+	FileID      string   `json:"fileid"`      // File ID.
+	PublicKey   string   `json:"publickey"`   // Peer ID of the blockchain that stores the file.
+	BlockNumber uint64   `json:"blocknumber"` // Block number that stores the file.
+	Keywords    []string `json:"keywords"`    // Keywords that matched.
+}
+
+type jsonPeer struct {
+	PeerID            string           `json:"peerid"`                // Peer ID. This is the compressed public key.
+	NodeID            string           `json:"nodeid"`                // Node ID. This is the blake3 hash of the peer ID.
+	UserAgent         string           `json:"useragent"`             // User Agent reported by the peer.
+	IsRoot            bool             `json:"isroot"`                // Whether the peer is a trusted root peer.
+	IsBehindNAT       bool             `json:"isbehindnat"`           // Whether the peer is behind a NAT.
+	IsFirewall        bool             `json:"isfirewall"`            // Whether the peer reported a firewall.
+	BlockchainHeight  uint64           `json:"blockchainheight"`      // Blockchain height.
+	BlockchainVersion uint64           `json:"blockchainversion"`     // Blockchain version.
+	PacketsSent       uint64           `json:"packetssent"`           // Count of packets sent.
+	PacketsReceived   uint64           `json:"packetsreceived"`       // Count of packets received.
+	RTT               int64            `json:"rtt"`                   // Round-trip time in milliseconds. 0 if not known.
+	Address           string           `json:"address"`               // Address of the first active connection. Empty if none.
+	Connections       []jsonConnection `json:"connections,omitempty"` // Active and inactive connections.
+}
+
+type jsonConnection struct {
+	Status        string    `json:"status"`        // Status of the connection: active, inactive, removed, redundant.
+	Adapter       string    `json:"adapter"`       // Name of the network adapter.
+	Local         string    `json:"local"`         // Local listening address.
+	Remote        string    `json:"remote"`        // Remote address.
+	LastPacketIn  time.Time `json:"lastpacketin"`  // Last time an incoming packet was received.
+	LastPacketOut time.Time `json:"lastpacketout"` // Last time an outgoing packet was sent.
+	RTT           int64     `json:"rtt"`           // Round-trip time in milliseconds. 0 if not known.
+	PortInternal  uint16    `json:"portinternal"`  // Internal listening port reported by the remote peer.
+	PortExternal  uint16    `json:"portexternal"`  // External listening port reported by the remote peer. 0 if not known.
+	Firewall      bool      `json:"firewall"`      // Whether the remote peer indicates a potential firewall.
+}
+
+type jsonNetwork struct {
+	Listen       string   `json:"listen"`                 // Listening address.
+	Multicast    string   `json:"multicast,omitempty"`    // IPv6 only: Multicast IP.
+	Broadcast    []string `json:"broadcast,omitempty"`    // IPv4 only: Broadcast IPs.
+	ExternalIP   string   `json:"externalip,omitempty"`   // External IP if known.
+	ExternalPort uint16   `json:"externalport,omitempty"` // External port if known.
+}
+
+type jsonStatus struct {
+	PeerID     string        `json:"peerid"`     // Peer ID of this node.
+	NodeID     string        `json:"nodeid"`     // Node ID of this node.
+	UserAgent  string        `json:"useragent"`  // User Agent of this node.
+	Features   uint8         `json:"features"`   // Feature bits.
+	IPv4Listen bool          `json:"ipv4listen"` // Feature bit IPv4 listen.
+	IPv6Listen bool          `json:"ipv6listen"` // Feature bit IPv6 listen.
+	Firewall   bool          `json:"firewall"`   // Feature bit firewall reported.
+	Networks   []jsonNetwork `json:"networks"`   // Listening networks.
+	Peers      []jsonPeer    `json:"peers"`      // Current peers.
+}
+
+type jsonUDTMetrics struct {
+	Started             time.Time `json:"started"`             // When the UDT connection was started.
+	DataSent            uint64    `json:"datasent"`            // Payload data sent in bytes.
+	DataReceived        uint64    `json:"datareceived"`        // Payload data received in bytes.
+	SpeedSend           float64   `json:"speedsend"`           // Send speed in bytes/second.
+	SpeedReceive        float64   `json:"speedreceive"`        // Receive speed in bytes/second.
+	HandshakeSent       uint64    `json:"handshakesent"`       // Handshake packets sent.
+	HandshakeReceived   uint64    `json:"handshakereceived"`   // Handshake packets received.
+	ShutdownSent        uint64    `json:"shutdownsent"`        // Shutdown packets sent.
+	ShutdownReceived    uint64    `json:"shutdownreceived"`    // Shutdown packets received.
+	ACKSent             uint64    `json:"acksent"`             // ACK packets sent.
+	ACKReceived         uint64    `json:"ackreceived"`         // ACK packets received.
+	NAKSent             uint64    `json:"naksent"`             // NAK packets sent.
+	NAKReceived         uint64    `json:"nakreceived"`         // NAK packets received.
+	ACK2Sent            uint64    `json:"ack2sent"`            // ACK2 packets sent.
+	ACK2Received        uint64    `json:"ack2received"`        // ACK2 packets received.
+	DataPacketsSent     uint64    `json:"datapacketssent"`     // Data packets sent including retransmissions.
+	DataPacketsReceived uint64    `json:"datapacketsreceived"` // Data packets received.
+}
+
+type jsonBlockRange struct {
+	Offset uint64 `json:"offset"` // First block number.
+	Limit  uint64 `json:"limit"`  // Count of blocks.
+}
+
+type jsonTransfer struct {
+	LiteID    string `json:"liteid"`    // Lite ID of the transfer session.
+	Type      string `json:"type"`      // Type of transfer: file, block.
+	PeerID    string `json:"peerid"`    // Peer ID of the remote peer.
+	Direction string `json:"direction"` // Direction: in, out, bi.
+
+	// File transfer
+	FileHash string `json:"filehash,omitempty"` // Hash of the file.
+	FileSize uint64 `json:"filesize,omitempty"` // File size if known.
+	Offset   uint64 `json:"offset,omitempty"`   // Offset to start the transfer.
+	Limit    uint64 `json:"limit,omitempty"`    // Limit in bytes to transfer.
+
+	// Block transfer
+	BlockchainPublicKey string           `json:"blockchainpublickey,omitempty"` // Target blockchain.
+	TargetBlocks        []jsonBlockRange `json:"targetblocks,omitempty"`        // Blocks to transfer.
+	LimitBlockCount     uint64           `json:"limitblockcount,omitempty"`     // Max count of blocks to transfer.
+	MaxBlockSize        uint64           `json:"maxblocksize,omitempty"`        // Max single block size.
+
+	Status          string          `json:"status"`          // Status: active, terminated.
+	TerminateReason int             `json:"terminatereason"` // Terminate reason. 0 if active.
+	Metrics         *jsonUDTMetrics `json:"metrics"`         // UDT metrics. Nil if the UDT connection is not established.
+}
+
+type jsonBlock struct {
+	PeerID            string             `json:"peerid"`            // Peer ID of the remote peer.
+	BlockNumber       uint64             `json:"blocknumber"`       // Block number.
+	BlockchainVersion uint64             `json:"blockchainversion"` // Blockchain version.
+	Size              int                `json:"size"`              // Size of the raw block in bytes.
+	Files             []jsonBlockFile    `json:"files"`             // File records.
+	Profile           []jsonProfileField `json:"profile"`           // Profile records.
+	UnknownRecords    int                `json:"unknownrecords"`    // Count of records that are not decoded.
+}
+
+type jsonBlockFile struct {
+	ID             string `json:"id"`             // File ID.
+	Hash           string `json:"hash"`           // Hash of the file data.
+	MerkleRootHash string `json:"merkleroothash"` // Merkle root hash.
+	FragmentSize   uint64 `json:"fragmentsize"`   // Fragment size.
+	Size           uint64 `json:"size"`           // File size.
+	Type           uint8  `json:"type"`           // File type.
+	Format         uint16 `json:"format"`         // File format.
+	Name           string `json:"name"`           // Name of the file.
+	Folder         string `json:"folder"`         // Folder of the file.
+	Description    string `json:"description"`    // Description.
+}
+
+type jsonProfileField struct {
+	Type uint16 `json:"type"` // Profile field type.
+	Data string `json:"data"` // Hex-encoded data.
+}
+
+func rttToMs(rtt time.Duration) int64 {
+	return rtt.Milliseconds()
+}
+
+func directionToA(direction int) string {
+	switch direction {
+	case core.DirectionIn:
+		return "in"
+	case core.DirectionOut:
+		return "out"
+	case core.DirectionBi:
+		return "bi"
+	default:
+		return "unknown"
+	}
+}
+
+func peerToJSON(peer *core.PeerInfo, withConnections bool) (result jsonPeer) {
+	result = jsonPeer{
+		PeerID:            hex.EncodeToString(peer.PublicKey.SerializeCompressed()),
+		NodeID:            hex.EncodeToString(peer.NodeID),
+		UserAgent:         strings.ToValidUTF8(peer.UserAgent, "?"),
+		IsRoot:            peer.IsRootPeer,
+		IsBehindNAT:       peer.IsBehindNAT(),
+		IsFirewall:        peer.IsFirewallReported(),
+		BlockchainHeight:  peer.BlockchainHeight,
+		BlockchainVersion: peer.BlockchainVersion,
+		PacketsSent:       peer.StatsPacketSent,
+		PacketsReceived:   peer.StatsPacketReceived,
+		RTT:               rttToMs(peer.GetRTT()),
+	}
+
+	connectionsActive := peer.GetConnections(true)
+	if len(connectionsActive) > 0 {
+		result.Address = addressToA(connectionsActive[0].Address)
+	}
+
+	if withConnections {
+		for _, c := range connectionsActive {
+			result.Connections = append(result.Connections, connectionToJSON(c))
+		}
+		for _, c := range peer.GetConnections(false) {
+			result.Connections = append(result.Connections, connectionToJSON(c))
+		}
+	}
+
+	return result
+}
+
+func connectionToJSON(c *core.Connection) jsonConnection {
+	listenAddress, _, _, _, _ := c.Network.GetListen()
+
+	return jsonConnection{
+		Status:        connectionStatusToA(c.Status),
+		Adapter:       c.Network.GetAdapterName(),
+		Local:         listenAddress.String(),
+		Remote:        addressToA(c.Address),
+		LastPacketIn:  c.LastPacketIn,
+		LastPacketOut: c.LastPacketOut,
+		RTT:           rttToMs(c.RoundTripTime),
+		PortInternal:  c.PortInternal,
+		PortExternal:  c.PortExternal,
+		Firewall:      c.Firewall,
+	}
+}
+
+func statusToJSON(backend *core.Backend) (result jsonStatus) {
+	_, publicKey := backend.ExportPrivateKey()
+	featureSupport := backend.FeatureSupport()
+
+	result = jsonStatus{
+		PeerID:     hex.EncodeToString(publicKey.SerializeCompressed()),
+		NodeID:     hex.EncodeToString(backend.SelfNodeID()),
+		UserAgent:  backend.SelfUserAgent(),
+		Features:   featureSupport,
+		IPv4Listen: featureSupport&(1<<protocol.FeatureIPv4Listen) > 0,
+		IPv6Listen: featureSupport&(1<<protocol.FeatureIPv6Listen) > 0,
+		Firewall:   featureSupport&(1<<protocol.FeatureFirewall) > 0,
+		Networks:   []jsonNetwork{},
+		Peers:      []jsonPeer{},
+	}
+
+	for _, network := range backend.GetNetworks(4) {
+		address, _, broadcastIPv4, ipExternal, externalPort := network.GetListen()
+
+		info := jsonNetwork{Listen: address.String(), ExternalPort: externalPort}
+		for _, broadcastIP := range broadcastIPv4 {
+			info.Broadcast = append(info.Broadcast, broadcastIP.String())
+		}
+		if ipExternal != nil && !ipExternal.IsUnspecified() {
+			info.ExternalIP = ipExternal.String()
+		}
+
+		result.Networks = append(result.Networks, info)
+	}
+	for _, network := range backend.GetNetworks(6) {
+		address, multicastIP, _, _, externalPort := network.GetListen()
+
+		result.Networks = append(result.Networks, jsonNetwork{Listen: address.String(), Multicast: multicastIP.String(), ExternalPort: externalPort})
+	}
+
+	for _, peer := range GetPeerlistSorted(backend) {
+		result.Peers = append(result.Peers, peerToJSON(peer, false))
+	}
+
+	return result
+}
+
+func metricsToJSON(metrics *udt.Metrics) *jsonUDTMetrics {
+	return &jsonUDTMetrics{
+		Started:             metrics.Started,
+		DataSent:            metrics.DataSent,
+		DataReceived:        metrics.DataReceived,
+		SpeedSend:           metrics.SpeedSend,
+		SpeedReceive:        metrics.SpeedReceive,
+		HandshakeSent:       metrics.PktSendHandShake,
+		HandshakeReceived:   metrics.PktRecvHandShake,
+		ShutdownSent:        metrics.PktSentShutdown,
+		ShutdownReceived:    metrics.PktRecvShutdown,
+		ACKSent:             metrics.PktSentACK,
+		ACKReceived:         metrics.PktRecvACK,
+		NAKSent:             metrics.PktSentNAK,
+		NAKReceived:         metrics.PktRecvNAK,
+		ACK2Sent:            metrics.PktSentACK2,
+		ACK2Received:        metrics.PktRecvACK2,
+		DataPacketsSent:     metrics.PktSentData,
+		DataPacketsReceived: metrics.PktRecvData,
+	}
+}
+
+func transfersToJSON(backend *core.Backend) (transfers []jsonTransfer) {
+	transfers = []jsonTransfer{}
+
+	for _, liteSession := range backend.LiteSessions() {
+		virtualConn, ok := liteSession.Data.(*core.VirtualPacketConn)
+		if !ok {
+			continue
+		}
+
+		transfer := jsonTransfer{
+			LiteID:          liteSession.ID.String(),
+			PeerID:          hex.EncodeToString(virtualConn.Peer.PublicKey.SerializeCompressed()),
+			Status:          "active",
+			TerminateReason: virtualConn.GetTerminateReason(),
+		}
+		if transfer.TerminateReason > 0 {
+			transfer.Status = "terminated"
+		}
+
+		var udtConn *udt.UDTSocket
+
+		if fileStats, ok := virtualConn.Stats.(*core.FileTransferStats); ok {
+			transfer.Type = "file"
+			transfer.Direction = directionToA(fileStats.Direction)
+			transfer.FileHash = hex.EncodeToString(fileStats.Hash)
+			transfer.FileSize = fileStats.FileSize
+			transfer.Offset = fileStats.Offset
+			transfer.Limit = fileStats.Limit
+			udtConn = fileStats.UDTConn
+		} else if blockStats, ok := virtualConn.Stats.(*core.BlockTransferStats); ok {
+			transfer.Type = "block"
+			transfer.Direction = directionToA(blockStats.Direction)
+			transfer.BlockchainPublicKey = hex.EncodeToString(blockStats.BlockchainPublicKey.SerializeCompressed())
+			transfer.LimitBlockCount = blockStats.LimitBlockCount
+			transfer.MaxBlockSize = blockStats.MaxBlockSize
+			for _, block := range blockStats.TargetBlocks {
+				transfer.TargetBlocks = append(transfer.TargetBlocks, jsonBlockRange{Offset: block.Offset, Limit: block.Limit})
+			}
+			udtConn = blockStats.UDTConn
+		} else {
+			continue
+		}
+
+		if udtConn != nil {
+			transfer.Metrics = metricsToJSON(udtConn.Metrics)
+		}
+
+		transfers = append(transfers, transfer)
+	}
+
+	return transfers
+}
+
+func networkListToJSON() (result []jsonInterface, err error) {
+	interfaceList, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ifaceSingle := range interfaceList {
+		info := jsonInterface{Name: ifaceSingle.Name, IPs: []string{}}
+
+		addresses, err := ifaceSingle.Addrs()
+		if err != nil {
+			info.Err = err.Error()
+		}
+		for _, address := range addresses {
+			info.IPs = append(info.IPs, address.(*net.IPNet).IP.String())
+		}
+
+		result = append(result, info)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,384 @@
+/*
+File Name:  Command Registry.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// command describes a single console command. Commands are registered via registerCommand, typically from an init function in the file implementing the handler.
+type command struct {
+	Name    string                        // Name of the command as typed by the user, for example "debug watch". Always lowercase.
+	Aliases []string                      // Alternative names, for example "?" for "help".
+	Args    []commandArgument             // Arguments of the command in the order they are requested.
+	Help    string                        // One-line help text shown in the command list.
+	Admin   bool                          // Whether the command requires the admin scope when executed via an API key with a lower scope.
+	Handler func(session *commandSession) // Handler executes the command.
+}
+
+// commandArgument describes a single argument of a command.
+// Arguments can be provided inline on the same line as the command. Missing arguments are read interactively.
+type commandArgument struct {
+	Name      string // Name of the argument, for example "block number".
+	Prompt    string // Prompt shown to the user before reading the argument interactively. Empty if none.
+	Rest      bool   // The argument takes the remaining text of the line. Only valid for the last argument.
+	Sensitive bool   // The argument contains a secret such as an API key. It is redacted in the audit log.
+}
+
+var commandList []*command
+var commandMap = make(map[string]*command)
+var commandMutex sync.RWMutex
+
+// registerCommand adds a command to the registry. It panics if the name or an alias is already registered, as this is a programming error.
+func registerCommand(cmd *command) {
+	commandMutex.Lock()
+	defer commandMutex.Unlock()
+
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if _, exists := commandMap[name]; exists {
+			panic("registerCommand: duplicate command '" + name + "'")
+		}
+		commandMap[name] = cmd
+	}
+
+	commandList = append(commandList, cmd)
+}
+
+// lookupCommand returns the command for the given name or alias. The input is case insensitive.
+func lookupCommand(name string) (cmd *command) {
+	commandMutex.RLock()
+	defer commandMutex.RUnlock()
+
+	return commandMap[strings.ToLower(name)]
+}
+
+// lookupCommandLine finds the command with the longest name matching the beginning of the tokens. The remaining tokens are returned as arguments.
+// Each word of the command name must be a separate token. A quoted token containing whitespace is always an argument.
+func lookupCommandLine(tokens []string) (cmd *command, args []string) {
+	words := len(tokens)
+	for n, token := range tokens {
+		if strings.ContainsAny(token, " \t") {
+			words = n
+			break
+		}
+	}
+
+	for n := words; n > 0; n-- {
+		if cmd = lookupCommand(strings.Join(tokens[:n], " ")); cmd != nil {
+			return cmd, tokens[n:]
+		}
+	}
+
+	return nil, nil
+}
+
+// usage returns the command name followed by the names of its arguments.
+func (cmd *command) usage() (text string) {
+	text = cmd.Name
+	for _, arg := range cmd.Args {
+		text += " <" + arg.Name + ">"
+	}
+	return text
+}
+
+// auditLine returns the command line for the audit log. Tokens of sensitive arguments are replaced by [redacted].
+// The arguments start at the token index first. If the command is nil, the tokens are returned unchanged.
+func (cmd *command) auditLine(tokens []string, first int) string {
+	line := append([]string{}, tokens...)
+
+	if cmd != nil && len(cmd.Args) > 0 {
+		for n := first; n < len(line); n++ {
+			// Additional tokens belong to the last argument if it takes the rest of the line.
+			arg := n - first
+			if arg >= len(cmd.Args) {
+				arg = len(cmd.Args) - 1
+			}
+			if cmd.Args[arg].Sensitive {
+				line[n] = "[redacted]"
+			}
+		}
+	}
+
+	return strings.Join(line, " ")
+}
+
+// splitCommandLine splits the line into tokens separated by whitespace. Double or single quotes at the beginning of a token group text containing spaces.
+// Quotes within a token are regular characters, for example in "it's". Within double quotes the backslash escapes the next character.
+// For each token the raw remainder of the line starting at the token is returned, which is used for arguments that take the rest of the line.
+func splitCommandLine(line string) (tokens, remainders []string, err error) {
+	var token strings.Builder
+	var starts []int
+	var quote rune
+	inToken := false
+	escape := false
+	end := 0
+
+	for i, c := range line {
+		if !inToken && c != ' ' && c != '\t' {
+			starts = append(starts, i)
+		}
+		if quote != 0 || c != ' ' && c != '\t' {
+			end = i + utf8.RuneLen(c)
+		}
+
+		switch {
+		case escape:
+			token.WriteRune(c)
+			escape = false
+		case quote == '"' && c == '\\':
+			escape = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			token.WriteRune(c)
+		case !inToken && (c == '"' || c == '\''):
+			quote = c
+			inToken = true
+		case c == ' ' || c == '\t':
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(c)
+			inToken = true
+		}
+	}
+
+	if quote != 0 || escape {
+		return nil, nil, errors.New("missing closing quote")
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+
+	for _, start := range starts {
+		remainders = append(remainders, line[start:end])
+	}
+
+	return tokens, remainders, nil
+}
+
+// listCommands returns all registered commands sorted by name.
+func listCommands() (list []*command) {
+	commandMutex.RLock()
+	list = append(list, commandList...)
+	commandMutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// newCommandSession creates a new session reading user input line by line from the input channel.
+// The session terminates when the input channel is closed or the context is cancelled.
+func newCommandSession(ctx context.Context, backend *core.Backend, input <-chan string, output io.Writer, outputJSON bool) (session *commandSession) {
+	return &commandSession{
+		backend:   backend,
+		ctx:       ctx,
+		input:     input,
+		output:    commandOutput{Writer: output, JSON: outputJSON},
+		monitorID: newMonitorSubscriber(),
+	}
+}
+
+// commandSession is the state of a single user session, either via the command line or the /console websocket.
+type commandSession struct {
+	backend *core.Backend
+	ctx     context.Context
+	input   <-chan string
+	output  commandOutput
+
+	monitorID   uint64 // Subscriber ID for monitored hashes. All subscriptions of the session are removed when it ends.
+	synchronous bool   // Background operations such as transfers block until completion. Used for non-interactive execution.
+	noPrompt    bool   // Missing arguments are not read interactively. The command fails instead.
+
+	cmd        *command // Currently executed command.
+	args       []string // Inline arguments of the current command.
+	failed     bool     // Whether the current command failed.
+	denied     bool     // Whether the current command was denied because the API key does not have the required scope.
+	terminated bool     // Whether the session was terminated while reading an argument.
+}
+
+// close releases all resources of the session. It must be called when the session ends.
+func (session *commandSession) close() {
+	hashMonitorRemoveAll(session.monitorID)
+}
+
+// execute parses the line and runs the command. Arguments may follow the command name on the same line.
+// It returns false if the command failed or is invalid.
+func (session *commandSession) execute(line string) (success bool) {
+	session.failed = false
+	session.terminated = false
+
+	tokens, remainders, err := splitCommandLine(line)
+	if err != nil {
+		session.errorf("Invalid input: %s.\n", err.Error())
+		return false
+	} else if len(tokens) == 0 {
+		return true
+	}
+
+	return session.executeTokens(tokens, remainders)
+}
+
+// executeTokens runs the command specified by the tokens. The tokens are the command name followed by the arguments.
+// Remainders contains for each token the raw text of the line starting at the token as returned by splitCommandLine. If nil, the tokens are joined with spaces for arguments that take the rest of the line.
+func (session *commandSession) executeTokens(tokens, remainders []string) (success bool) {
+	session.failed = false
+	session.terminated = false
+	session.denied = false
+
+	cmd, args := lookupCommandLine(tokens)
+	first := len(tokens) - len(args)
+
+	defer func() {
+		result := "success"
+		if session.denied {
+			result = "denied"
+		} else if !success {
+			result = "failed"
+		}
+		auditCommand(session.ctx, session.backend, cmd.auditLine(tokens, first), result)
+	}()
+
+	if cmd == nil {
+		session.errorf("Unknown command.\n")
+		return false
+	}
+
+	// Use the remaining text of the line exactly as typed including any quotes if the last argument takes the rest of the line, regardless of the count of tokens.
+	// The args share the array with the tokens and must not be modified.
+	if count := len(cmd.Args); count > 0 && cmd.Args[count-1].Rest && len(args) >= count {
+		rest := strings.Join(args[count-1:], " ")
+		if n := first + count - 1; n < len(remainders) {
+			rest = remainders[n]
+		}
+		args = append(append([]string{}, args[:count-1]...), rest)
+	}
+	if len(args) > len(cmd.Args) {
+		session.errorf("Too many arguments. Usage: %s\n", cmd.usage())
+		return false
+	} else if session.noPrompt && len(args) < len(cmd.Args) {
+		session.errorf("Missing arguments. Usage: %s\n", cmd.usage())
+		return false
+	}
+
+	if cmd.Admin && apiScopeFromContext(session.ctx) < apiScopeAdmin {
+		session.denied = true
+		session.errorf("Permission denied. The command requires an API key with admin scope.\n")
+		return false
+	}
+
+	session.cmd = cmd
+	session.args = args
+	cmd.Handler(session)
+	session.cmd = nil
+	session.args = nil
+
+	return !session.failed && !session.terminated
+}
+
+// errorf writes the error message to the output and marks the current command as failed.
+func (session *commandSession) errorf(format string, v ...interface{}) {
+	session.failed = true
+	session.output.errorf(format, v...)
+}
+
+// background runs the function in a Go routine so the user may continue to enter commands. The function returns whether it succeeded.
+// In synchronous mode the function is executed directly and its result is reflected in the command status.
+func (session *commandSession) background(function func() (success bool)) {
+	if !session.synchronous {
+		go function()
+		return
+	}
+
+	if !function() {
+		session.failed = true
+	}
+}
+
+// argPrompt shows the prompt of the argument, if any.
+func (session *commandSession) argPrompt(n int) {
+	if session.cmd != nil && n < len(session.cmd.Args) && session.cmd.Args[n].Prompt != "" {
+		if session.output.JSON {
+			session.output.writeJSON(jsonPrompt{Prompt: session.cmd.Args[n].Prompt})
+			return
+		}
+		fmt.Fprintf(session.output, "%s\n", session.cmd.Args[n].Prompt)
+	}
+}
+
+// argString returns the argument n as text. If it was not provided inline, it is read interactively.
+func (session *commandSession) argString(n int) (text string, valid, terminate bool) {
+	if n < len(session.args) {
+		return session.args[n], true, false
+	}
+
+	session.argPrompt(n)
+	text, valid, terminate = getUserOptionString(session.ctx, session.input)
+	session.terminated = session.terminated || terminate
+	return text, valid, terminate
+}
+
+// argInt returns the argument n as integer. If it was not provided inline, it is read interactively.
+func (session *commandSession) argInt(n int) (number int, valid, terminate bool) {
+	if n < len(session.args) {
+		number, err := strconv.Atoi(session.args[n])
+		return number, err == nil, false
+	}
+
+	session.argPrompt(n)
+	number, valid, terminate = getUserOptionInt(session.ctx, session.input)
+	session.terminated = session.terminated || terminate
+	return number, valid, terminate
+}
+
+// argHash returns the argument n as hex-decoded 256-bit hash. If it was not provided inline, it is read interactively.
+func (session *commandSession) argHash(n int) (hash []byte, valid, terminate bool) {
+	if n < len(session.args) {
+		hash, err := hex.DecodeString(session.args[n])
+		return hash, err == nil && len(hash) == 256/8, false
+	}
+
+	session.argPrompt(n)
+	hash, valid, terminate = getUserOptionHash(session.ctx, session.input)
+	session.terminated = session.terminated || terminate
+	return hash, valid, terminate
+}
+
+func showHelp(output commandOutput) {
+	if output.JSON {
+		for _, cmd := range listCommands() {
+			info := jsonCommand{Name: cmd.Name, Aliases: cmd.Aliases, Arguments: []string{}, Help: cmd.Help}
+			for _, arg := range cmd.Args {
+				info.Arguments = append(info.Arguments, arg.Name)
+			}
+			output.writeJSON(info)
+		}
+		return
+	}
+
+	text := "Please enter a command. Arguments may be provided on the same line, quotes group text with spaces:\n"
+	for _, cmd := range listCommands() {
+		text += fmt.Sprintf("%-40s %s\n", cmd.usage(), cmd.Help)
+	}
+
+	fmt.Fprint(output, text+"\n")
+}
@@ -0,0 +1,159 @@
+/*
+File Name:  Command Registry_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Tests of the command line parsing and the command lookup.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/PeernetOfficial/core"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		line       string
+		tokens     []string
+		remainders []string
+		err        bool
+	}{
+		{line: "", tokens: nil, remainders: nil},
+		{line: "   \t ", tokens: nil, remainders: nil},
+		{line: "status", tokens: []string{"status"}, remainders: []string{"status"}},
+		{line: "  debug   watch\tabc  ", tokens: []string{"debug", "watch", "abc"}, remainders: []string{"debug   watch\tabc", "watch\tabc", "abc"}},
+
+		// quotes
+		{line: `chat "a b" c`, tokens: []string{"chat", "a b", "c"}, remainders: []string{`chat "a b" c`, `"a b" c`, "c"}},
+		{line: `chat 'a b'`, tokens: []string{"chat", "a b"}, remainders: []string{`chat 'a b'`, `'a b'`}},
+		{line: `chat "it's"`, tokens: []string{"chat", "it's"}, remainders: []string{`chat "it's"`, `"it's"`}},
+		{line: `chat it's`, tokens: []string{"chat", "it's"}, remainders: []string{"chat it's", "it's"}},
+		{line: `chat a"b c"`, tokens: []string{"chat", `a"b`, `c"`}, remainders: []string{`chat a"b c"`, `a"b c"`, `c"`}},
+		{line: `chat "a"b`, tokens: []string{"chat", "ab"}, remainders: []string{`chat "a"b`, `"a"b`}},
+		{line: `chat "a  b  "`, tokens: []string{"chat", "a  b  "}, remainders: []string{`chat "a  b  "`, `"a  b  "`}},
+
+		// empty quotes
+		{line: `chat ""`, tokens: []string{"chat", ""}, remainders: []string{`chat ""`, `""`}},
+		{line: `get block "" 1`, tokens: []string{"get", "block", "", "1"}, remainders: []string{`get block "" 1`, `block "" 1`, `"" 1`, "1"}},
+
+		// escapes
+		{line: `chat "a \"b\""`, tokens: []string{"chat", `a "b"`}, remainders: []string{`chat "a \"b\""`, `"a \"b\""`}},
+		{line: `chat "a\\b"`, tokens: []string{"chat", `a\b`}, remainders: []string{`chat "a\\b"`, `"a\\b"`}},
+		{line: `chat 'a\b'`, tokens: []string{"chat", `a\b`}, remainders: []string{`chat 'a\b'`, `'a\b'`}},
+		{line: `chat a\b`, tokens: []string{"chat", `a\b`}, remainders: []string{`chat a\b`, `a\b`}},
+
+		// unicode
+		{line: "chat \"grüße\" ✓", tokens: []string{"chat", "grüße", "✓"}, remainders: []string{"chat \"grüße\" ✓", "\"grüße\" ✓", "✓"}},
+
+		// unterminated quotes
+		{line: `chat "abc`, err: true},
+		{line: `chat 'abc`, err: true},
+		{line: `chat "abc\"`, err: true},
+		{line: `chat "abc\`, err: true},
+	}
+
+	for _, test := range tests {
+		tokens, remainders, err := splitCommandLine(test.line)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got tokens %q", test.line, tokens)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.line, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("%s: got tokens %q, want %q", test.line, tokens, test.tokens)
+		}
+		if !reflect.DeepEqual(remainders, test.remainders) {
+			t.Errorf("%s: got remainders %q, want %q", test.line, remainders, test.remainders)
+		}
+	}
+}
+
+func TestLookupCommandLine(t *testing.T) {
+	tests := []struct {
+		tokens []string
+		name   string // Expected command name. Empty if not found.
+		args   []string
+	}{
+		{tokens: []string{"status"}, name: "status", args: []string{}},
+		{tokens: []string{"STATUS"}, name: "status", args: []string{}},
+		{tokens: []string{"?"}, name: "help", args: []string{}},
+		{tokens: []string{"debug", "watch", "abc"}, name: "debug watch", args: []string{"abc"}},
+		{tokens: []string{"debug", "watch", "searches", "1"}, name: "debug watch searches", args: []string{"1"}},
+		{tokens: []string{"Debug", "Watch", "Incoming"}, name: "debug watch incoming", args: []string{}},
+		{tokens: []string{"chat", "all", "hello"}, name: "chat", args: []string{"hello"}},
+		{tokens: []string{"chat", "hello", "all"}, name: "chat", args: []string{"hello", "all"}},
+		{tokens: []string{"debug", "watch", "a b"}, name: "debug watch", args: []string{"a b"}},
+		{tokens: []string{"debug watch", "abc"}},
+		{tokens: []string{"debug", "watch searches"}},
+		{tokens: []string{"debug"}},
+		{tokens: []string{"unknown", "command"}},
+		{tokens: []string{"watch", "debug"}},
+	}
+
+	for _, test := range tests {
+		cmd, args := lookupCommandLine(test.tokens)
+		if test.name == "" {
+			if cmd != nil {
+				t.Errorf("%q: got command %s, want none", test.tokens, cmd.Name)
+			}
+			continue
+		} else if cmd == nil {
+			t.Errorf("%q: command not found, want %s", test.tokens, test.name)
+			continue
+		}
+
+		if cmd.Name != test.name {
+			t.Errorf("%q: got command %s, want %s", test.tokens, cmd.Name, test.name)
+		}
+		if len(args) != len(test.args) || len(args) > 0 && !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%q: got args %q, want %q", test.tokens, args, test.args)
+		}
+	}
+}
+
+// TestRestArgument checks that an argument taking the rest of the line uses the text exactly as typed, for single and multiple tokens.
+func TestRestArgument(t *testing.T) {
+	tests := []struct {
+		line string
+		text string // Expected text passed to the hash command.
+	}{
+		{line: "hash abc", text: "abc"},
+		{line: `hash "abc"`, text: `"abc"`},
+		{line: `hash "a b" c`, text: `"a b" c`},
+		{line: "hash a   b", text: "a   b"},
+		{line: "hash   a b   ", text: "a b"},
+		{line: `hash ""`, text: `""`},
+		{line: `hash it's`, text: "it's"},
+	}
+
+	for _, test := range tests {
+		var output bytes.Buffer
+		session := newCommandSession(context.Background(), nil, nil, &output, true)
+		session.noPrompt = true
+
+		if !session.execute(test.line) {
+			t.Errorf("%s: command failed: %s", test.line, output.String())
+			continue
+		}
+
+		var result jsonHash
+		if err := json.Unmarshal(output.Bytes(), &result); err != nil {
+			t.Errorf("%s: invalid output %s: %v", test.line, output.String(), err)
+		} else if expected := hex.EncodeToString(core.Data2Hash([]byte(test.text))); result.Hash != expected {
+			t.Errorf("%s: hash does not match text %q", test.line, test.text)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+/*
+File Name:  Config.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Settings of this application from the Cmd settings file, environment variables and command line parameters.
+Command line parameters take precedence over environment variables, which take precedence over the Cmd settings file.
+
+The settings are stored in a separate file owned by this application, because core deletes unknown settings when it saves its config file.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	registerCommand(&command{Name: "config show", Help: "Show the effective settings and where they come from", Handler: cmdConfigShow})
+}
+
+// configFile is the config file of core. It can be changed via the -config parameter.
+var configFile = "Config.yaml"
+
+// configCmdFile is the settings file of this application. It can be changed via the -cmdconfig parameter. By default it is derived from the config file via configCmdFilename.
+var configCmdFile string
+
+// configEnvironmentPrefix is the prefix of environment variables that override settings from the config file.
+// The variable name is the prefix followed by the uppercase setting name, for example PEERNET_APILISTEN.
+const configEnvironmentPrefix = "PEERNET_"
+
+// Sources of settings as reported by the config show command.
+const (
+	configSourceDefault     = "default"
+	configSourceFile        = "settings file"
+	configSourceEnvironment = "environment"
+	configSourceCommandLine = "command line"
+)
+
+// configEnvironment contains the names of the settings overridden by environment variables.
+var configEnvironment map[string]bool
+
+// configParams contains the command line parameters.
+var configParams *cmdParams
+
+var configMutex sync.RWMutex
+
+// configSecrets are settings that are never shown.
+var configSecrets = map[string]bool{"APIKey": true}
+
+// configParamSettings maps command line parameters to the settings they override.
+var configParamSettings = map[string]string{
+	"webapi":          "APIListen",
+	"apikey":          "APIKey",
+	"apissl":          "APIUseSSL",
+	"apicert":         "APICertificateFile",
+	"apicertkey":      "APICertificateKey",
+	"apitimeoutread":  "APITimeoutRead",
+	"apitimeoutwrite": "APITimeoutWrite",
+}
+
+// configCmdFilename returns the Cmd settings file for the config file, for example "Config.cmd.yaml" for "Config.yaml".
+func configCmdFilename(configFile string) string {
+	return strings.TrimSuffix(configFile, filepath.Ext(configFile)) + ".cmd.yaml"
+}
+
+// configLoad reads and validates the Cmd settings file. Unknown settings are rejected.
+// If the file does not exist, the settings are migrated from the core config file and migrated is set if any were found.
+func configLoad(cmdFile, coreFile string) (loaded cmdConfig, migrated bool, err error) {
+	data, err := os.ReadFile(cmdFile)
+	if err != nil && os.IsNotExist(err) {
+		return configMigrate(cmdFile, coreFile)
+	} else if err != nil {
+		return loaded, false, err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&loaded); err != nil && err != io.EOF {
+		return loaded, false, err
+	}
+
+	return loaded, false, configValidate(&loaded)
+}
+
+// configMigrate creates the Cmd settings file with the settings of this application from the core config file, where they were stored by previous versions.
+// If the core config file does not contain any, the Cmd settings file is created with the default settings.
+func configMigrate(cmdFile, coreFile string) (migrated cmdConfig, found bool, err error) {
+	if status, err := core.LoadConfig(coreFile, &migrated); status != core.ExitSuccess {
+		return migrated, false, fmt.Errorf("reading config file '%s': %w", coreFile, err)
+	}
+
+	inFile := configFileSettings(coreFile)
+	for _, name := range configSettingNames() {
+		found = found || inFile[name]
+	}
+
+	if err = configValidate(&migrated); err != nil {
+		return migrated, found, err
+	}
+
+	return migrated, found, core.SaveConfig(cmdFile, migrated)
+}
+
+// configValidate checks the settings for invalid values.
+func configValidate(settings *cmdConfig) (err error) {
+	for _, listen := range settings.APIListen {
+		if path, ok := apiSocketPath(listen); ok {
+			if path == "" {
+				return fmt.Errorf("invalid APIListen '%s': missing socket path", listen)
+			}
+		} else if _, _, err = net.SplitHostPort(listen); err != nil {
+			return fmt.Errorf("invalid APIListen '%s': %w", listen, err)
+		}
+	}
+
+	for _, duration := range []struct{ name, value string }{
+		{"APITimeoutRead", settings.APITimeoutRead},
+		{"APITimeoutWrite", settings.APITimeoutWrite},
+		{"ShutdownTimeout", settings.ShutdownTimeout},
+		{"APIAuthBackoff", settings.APIAuthBackoff},
+		{"APIAuthLockout", settings.APIAuthLockout},
+	} {
+		if _, err = parseDuration(duration.value); err != nil {
+			return fmt.Errorf("invalid %s '%s': %w", duration.name, duration.value, err)
+		}
+	}
+
+	if _, err = apiKeysLoad(settings.APIKey, settings.APIKeys); err != nil {
+		return err
+	}
+
+	for _, origin := range settings.APIAllowedOrigins {
+		if originURL, err := url.Parse(origin); origin != "*" && (err != nil || originURL.Scheme == "" || originURL.Host == "") {
+			return fmt.Errorf("invalid APIAllowedOrigins '%s': must be in the format scheme://host[:port]", origin)
+		}
+	}
+
+	if _, err = parseSocketMode(settings.APISocketMode); err != nil {
+		return err
+	}
+
+	if settings.APIAuthMaxFailures < 0 {
+		return fmt.Errorf("invalid APIAuthMaxFailures %d: must not be negative", settings.APIAuthMaxFailures)
+	}
+
+	if settings.AuditLogMaxSize < 0 || settings.AuditLogMaxFiles < 0 {
+		return fmt.Errorf("invalid AuditLogMaxSize %d or AuditLogMaxFiles %d: must not be negative", settings.AuditLogMaxSize, settings.AuditLogMaxFiles)
+	}
+
+	if settings.ReadyMinPeers < 0 {
+		return fmt.Errorf("invalid ReadyMinPeers %d: must not be negative", settings.ReadyMinPeers)
+	}
+
+	return nil
+}
+
+// configSettingNames returns the names of all settings of this application as used in the files.
+func configSettingNames() (names []string) {
+	settingsType := reflect.TypeOf(cmdConfig{})
+	for n := 0; n < settingsType.NumField(); n++ {
+		names = append(names, settingsType.Field(n).Tag.Get("yaml"))
+	}
+	return names
+}
+
+// configApplyEnvironment returns the config with the environment variables applied, and the names of the overridden settings.
+// An error is returned if the value of an environment variable is invalid.
+func configApplyEnvironment(fileConfig cmdConfig) (effective cmdConfig, overridden map[string]bool, err error) {
+	effective = fileConfig
+	overridden = make(map[string]bool)
+
+	value := reflect.ValueOf(&effective).Elem()
+	for n := 0; n < value.NumField(); n++ {
+		name := value.Type().Field(n).Tag.Get("yaml")
+		variable := configEnvironmentPrefix + strings.ToUpper(name)
+
+		text, ok := os.LookupEnv(variable)
+		if !ok {
+			continue
+		}
+
+		if err = configSetField(value.Field(n), text); err != nil {
+			return effective, overridden, fmt.Errorf("invalid environment variable %s: %w", variable, err)
+		}
+
+		overridden[name] = true
+	}
+
+	return effective, overridden, nil
+}
+
+// configSetField sets the field from the text. Lists are separated by comma. Lists of structures such as APIKeys are in YAML or JSON format.
+func configSetField(field reflect.Value, text string) (err error) {
+	if field.Type() == reflect.TypeOf(uuid.UUID{}) {
+		id, err := uuid.Parse(text)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(id))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.Atoi(text)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(i))
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			list := reflect.New(field.Type())
+			decoder := yaml.NewDecoder(strings.NewReader(text))
+			decoder.KnownFields(true)
+			if err := decoder.Decode(list.Interface()); err != nil && err != io.EOF {
+				return err
+			}
+			field.Set(list.Elem())
+			return nil
+		}
+		var list []string
+		if text != "" {
+			list = strings.Split(text, ",")
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type().String())
+	}
+
+	return nil
+}
+
+// configFormatField returns the field value as text. Lists are separated by comma.
+func configFormatField(field reflect.Value) string {
+	switch value := field.Interface().(type) {
+	case []string:
+		return strings.Join(value, ",")
+	case []apiKeyConfig:
+		// Only the names and scopes are shown, never the keys.
+		var names []string
+		for _, key := range value {
+			names = append(names, key.Name+" ("+key.Scope+")")
+		}
+		return strings.Join(names, ",")
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// configFileSettings returns the names of the settings present in the file.
+func configFileSettings(filename string) (names map[string]bool) {
+	var file map[string]interface{}
+	core.LoadConfig(filename, &file)
+
+	names = make(map[string]bool)
+	for name := range file {
+		names[name] = true
+	}
+	return names
+}
+
+type jsonConfig struct {
+	File     string              `json:"file"`     // Cmd settings file.
+	Settings []jsonConfigSetting `json:"settings"` // Effective settings.
+}
+
+type jsonConfigSetting struct {
+	Name   string `json:"name"`   // Name of the setting as used in the config file.
+	Value  string `json:"value"`  // Effective value. Secrets are redacted.
+	Source string `json:"source"` // Source of the value: default, settings file, environment, command line.
+}
+
+// configEffective returns the effective settings and their sources.
+func configEffective() (result jsonConfig) {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+
+	result.File = configCmdFile
+	inFile := configFileSettings(configCmdFile)
+
+	// Command line parameters are looked up by their flag names.
+	params := make(map[string]string)
+	if configParams != nil {
+		for name := range configParams.APIFlags {
+			if setting, ok := configParamSettings[name]; ok {
+				params[setting] = flag.Lookup(name).Value.String()
+			}
+		}
+	}
+
+	value := reflect.ValueOf(&config).Elem()
+	for n := 0; n < value.NumField(); n++ {
+		setting := jsonConfigSetting{Name: value.Type().Field(n).Tag.Get("yaml"), Value: configFormatField(value.Field(n)), Source: configSourceDefault}
+
+		if text, ok := params[setting.Name]; ok {
+			setting.Value = text
+			setting.Source = configSourceCommandLine
+		} else if configEnvironment[setting.Name] {
+			setting.Source = configSourceEnvironment
+		} else if inFile[setting.Name] {
+			setting.Source = configSourceFile
+		}
+
+		if configSecrets[setting.Name] && (!value.Field(n).IsZero() || setting.Source == configSourceCommandLine) {
+			setting.Value = "[redacted]"
+		}
+
+		result.Settings = append(result.Settings, setting)
+	}
+
+	return result
+}
+
+func cmdConfigShow(session *commandSession) {
+	effective := configEffective()
+
+	if session.output.JSON {
+		session.output.writeJSON(&effective)
+		return
+	}
+
+	fmt.Fprintf(session.output, "Settings file: %s\n\n", effective.File)
+	for _, setting := range effective.Settings {
+		fmt.Fprintf(session.output, "%-22s %-40s %s\n", setting.Name, setting.Value, setting.Source)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+File Name:  Console RPC.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Framed JSON protocol for the /console websocket, enabled via /console?mode=json.
+Each websocket message sent to the API is a single request frame. For each request exactly one response frame is returned.
+Output that does not belong to a request, or that is written after the request completed, is sent as event frame.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// consoleRequest is a request frame sent by the client.
+type consoleRequest struct {
+	ID      json.RawMessage `json:"id"`      // Request ID chosen by the client. It is returned as-is in the response and in related events.
+	Command string          `json:"command"` // Command name, for example "peer list".
+	Args    []string        `json:"args"`    // Arguments of the command.
+}
+
+// consoleResponse is the response frame sent when a request completes.
+type consoleResponse struct {
+	Type    string            `json:"type"`            // Always "response".
+	ID      json.RawMessage   `json:"id"`              // Request ID.
+	Status  string            `json:"status"`          // Status of the command: "success" or "error".
+	Results []json.RawMessage `json:"results"`         // Results of the command. Text output is returned as JSON string.
+	Error   string            `json:"error,omitempty"` // Error message in case the command failed.
+}
+
+// consoleEvent is a frame for asynchronous output.
+type consoleEvent struct {
+	Type  string          `json:"type"`         // Always "event".
+	Event string          `json:"event"`        // Event type: "output" for output of a command, "error" for an error of a command, "log" for backend output.
+	ID    json.RawMessage `json:"id,omitempty"` // Request ID of the command that caused the event, if any.
+	Data  json.RawMessage `json:"data"`         // Output data. Text output is returned as JSON string.
+}
+
+// Status values in response frames.
+const (
+	consoleStatusSuccess = "success"
+	consoleStatusError   = "error"
+)
+
+// Event types.
+const (
+	consoleEventOutput = "output"
+	consoleEventError  = "error"
+	consoleEventLog    = "log"
+)
+
+// consoleRPC executes request frames received on the input channel until it is closed or the context is cancelled.
+// Frames are written to the frames writer. Commands are executed one after another, and missing arguments are not prompted for.
+func consoleRPC(ctx context.Context, backend *core.Backend, input <-chan string, frames io.Writer) {
+	session := newCommandSession(ctx, backend, nil, frames, true)
+	session.synchronous = true
+	session.noPrompt = true
+	defer session.close()
+
+	for {
+		var message string
+		var ok bool
+
+		select {
+		case message, ok = <-input:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+
+		var request consoleRequest
+		if err := json.Unmarshal([]byte(message), &request); err != nil {
+			writeFrame(frames, &consoleResponse{Type: "response", ID: request.ID, Status: consoleStatusError, Results: []json.RawMessage{}, Error: "Invalid request frame: " + err.Error()})
+			continue
+		}
+
+		tokens := append(strings.Fields(request.Command), request.Args...)
+		if len(tokens) == 0 {
+			writeFrame(frames, &consoleResponse{Type: "response", ID: request.ID, Status: consoleStatusError, Results: []json.RawMessage{}, Error: "Missing command."})
+			continue
+		}
+
+		writer := &consoleRequestWriter{id: request.ID, frames: frames}
+		session.output = commandOutput{Writer: writer, JSON: true}
+
+		success := session.executeTokens(tokens, nil)
+
+		writeFrame(frames, writer.complete(success))
+	}
+}
+
+// consoleRequestWriter collects the output of a single request. It is safe for concurrent use.
+// Once the request completed, any further output (for example from a monitor started by the command) is sent as event frame.
+type consoleRequestWriter struct {
+	sync.Mutex
+	id        json.RawMessage
+	frames    io.Writer
+	buffer    bytes.Buffer
+	errors    []string
+	completed bool
+}
+
+func (writer *consoleRequestWriter) Write(p []byte) (n int, err error) {
+	writer.Lock()
+	defer writer.Unlock()
+
+	if !writer.completed {
+		return writer.buffer.Write(p)
+	}
+
+	for _, data := range frameData(p) {
+		writeFrame(writer.frames, &consoleEvent{Type: "event", Event: consoleEventOutput, ID: writer.id, Data: data})
+	}
+
+	return len(p), nil
+}
+
+// writeError is called for error messages of the command.
+func (writer *consoleRequestWriter) writeError(message string) {
+	writer.Lock()
+	defer writer.Unlock()
+
+	if !writer.completed {
+		writer.errors = append(writer.errors, message)
+		return
+	}
+
+	data, _ := json.Marshal(message)
+	writeFrame(writer.frames, &consoleEvent{Type: "event", Event: consoleEventError, ID: writer.id, Data: data})
+}
+
+// complete marks the request as completed and returns the response frame.
+func (writer *consoleRequestWriter) complete(success bool) (response *consoleResponse) {
+	writer.Lock()
+	defer writer.Unlock()
+
+	writer.completed = true
+
+	response = &consoleResponse{Type: "response", ID: writer.id, Status: consoleStatusSuccess, Results: frameData(writer.buffer.Bytes()), Error: strings.Join(writer.errors, "\n")}
+	if !success {
+		response.Status = consoleStatusError
+	}
+
+	return response
+}
+
+// consoleEventWriter sends each write as event frame. It is used for output not related to any request.
+type consoleEventWriter struct {
+	event  string
+	frames io.Writer
+}
+
+func (writer *consoleEventWriter) Write(p []byte) (n int, err error) {
+	for _, data := range frameData(p) {
+		writeFrame(writer.frames, &consoleEvent{Type: "event", Event: writer.event, Data: data})
+	}
+
+	return len(p), nil
+}
+
+// frameData splits the output into lines. Lines containing a JSON document are returned as-is, other lines are encoded as JSON string.
+func frameData(output []byte) (data []json.RawMessage) {
+	data = []json.RawMessage{}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if json.Valid([]byte(line)) && strings.HasPrefix(strings.TrimSpace(line), "{") {
+			data = append(data, json.RawMessage(line))
+			continue
+		}
+
+		encoded, _ := json.Marshal(line)
+		data = append(data, encoded)
+	}
+
+	return data
+}
+
+// writeFrame encodes the frame as JSON and writes it as single message.
+func writeFrame(frames io.Writer, frame interface{}) {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return
+	}
+
+	frames.Write(data)
+}
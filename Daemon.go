@@ -0,0 +1,88 @@
+/*
+File Name:  Daemon.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Daemon mode via the -daemon parameter. The interactive command line is not started and output is only written to the log file.
+Readiness and stopping are reported to the service manager via the socket specified in the NOTIFY_SOCKET environment variable (systemd Type=notify).
+*/
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// daemonActive indicates whether the application runs in daemon mode.
+var daemonActive bool
+
+// daemonPIDFile is the PID file written in daemon mode. Empty if none.
+var daemonPIDFile string
+var daemonPIDFileMutex sync.Mutex
+
+// daemonStart prepares the daemon mode. It writes the PID file and restricts the log output to the log file.
+func daemonStart(backend *core.Backend, pidFile string) (err error) {
+	daemonActive = true
+
+	if pidFile != "" {
+		if err = os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			return err
+		}
+
+		daemonPIDFileMutex.Lock()
+		daemonPIDFile = pidFile
+		daemonPIDFileMutex.Unlock()
+	}
+
+	// The setting is not saved.
+	backend.Config.LogTarget = daemonLogTarget(backend.Config.LogTarget)
+
+	return nil
+}
+
+// daemonLogTarget returns the log target to use. Log target 1 = command line and 2 = log file + command line are changed to 0 = log file in daemon mode, as there is no command line.
+func daemonLogTarget(target int) int {
+	if daemonActive && (target == 1 || target == 2) {
+		return 0
+	}
+	return target
+}
+
+// daemonStop removes the PID file, if any.
+func daemonStop() {
+	daemonPIDFileMutex.Lock()
+	defer daemonPIDFileMutex.Unlock()
+
+	if daemonPIDFile != "" {
+		os.Remove(daemonPIDFile)
+		daemonPIDFile = ""
+	}
+}
+
+// sdNotify sends the state to the service manager, for example "READY=1". It does nothing if the NOTIFY_SOCKET environment variable is not set.
+// See https://www.freedesktop.org/software/systemd/man/sd_notify.html for the protocol.
+func sdNotify(state string) (err error) {
+	socketAddr := os.Getenv("NOTIFY_SOCKET")
+	if socketAddr == "" {
+		return nil
+	}
+
+	// A leading @ indicates a socket in the abstract namespace.
+	if socketAddr[0] == '@' {
+		socketAddr = "\x00" + socketAddr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketAddr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
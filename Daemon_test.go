@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+/*
+File Name:  Daemon_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSdNotify sends the states to a fake notify socket as created by the service manager.
+func TestSdNotify(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("error creating notify socket: %v", err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+
+	for _, state := range []string{"READY=1", "STOPPING=1"} {
+		if err := sdNotify(state); err != nil {
+			t.Fatalf("error sending '%s': %v", state, err)
+		}
+
+		buffer := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("error receiving '%s': %v", state, err)
+		} else if string(buffer[:n]) != state {
+			t.Fatalf("received '%s', expected '%s'", string(buffer[:n]), state)
+		}
+	}
+}
+
+// TestSdNotifyNoSocket checks that nothing is sent if the application is not started by a service manager.
+func TestSdNotifyNoSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("unexpected error without notify socket: %v", err)
+	}
+}
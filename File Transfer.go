@@ -17,53 +17,108 @@ import (
 	"github.com/PeernetOfficial/core/protocol"
 	"github.com/PeernetOfficial/core/udt"
 	"github.com/PeernetOfficial/core/warehouse"
+	"github.com/PeernetOfficial/core/webapi"
 )
 
+func init() {
+	registerCommand(&command{Name: "probe file transfer", Help: "Attempts to transfer and validate a remote file against a local file", Handler: cmdProbeFileTransfer,
+		Args: []commandArgument{{Name: "peer", Prompt: "Enter peer ID or node ID to connect:"}, {Name: "file hash", Prompt: "Enter file hash:"}}})
+}
+
+func cmdProbeFileTransfer(session *commandSession) {
+	nodeIDA, _, terminate := session.argString(0)
+	if terminate {
+		return
+	}
+	fileHashA, _, terminate := session.argString(1)
+	if terminate {
+		return
+	}
+
+	fileHash, valid1 := webapi.DecodeBlake3Hash(fileHashA)
+	nodeID, valid2 := webapi.DecodeBlake3Hash(nodeIDA)
+	publicKey, err3 := core.PublicKeyFromPeerID(nodeIDA)
+
+	if !valid2 && err3 != nil {
+		session.errorf("Invalid peer ID or node ID.\n")
+		return
+	} else if !valid1 {
+		session.errorf("Invalid file hash.\n")
+		return
+	}
+
+	var peer *core.PeerInfo
+	var err error
+	timeout := time.Second * 10
+
+	if valid2 {
+		peer, err = webapi.PeerConnectNode(session.backend, nodeID, timeout)
+	} else if err3 == nil {
+		peer, err = webapi.PeerConnectPublicKey(session.backend, publicKey, timeout)
+	}
+	if err != nil {
+		session.errorf("Could not connect to peer: %s\n", err.Error())
+		return
+	}
+
+	output := session.output
+	session.background(func() bool { return transferCompareFile(peer, fileHash, output) })
+}
+
 // transferCompareFile downloads a file from a remote peer and compares it with the same file in the local warehouse.
 // This function exists to test a file transfer.
 // Note: The file MUST be stored locally, otherwise this function fails.
-func transferCompareFile(peer *core.PeerInfo, fileHash []byte, output io.Writer) {
+// In JSON mode the progress is written as jsonProbeStatus documents and the result as jsonProbeResult document.
+func transferCompareFile(peer *core.PeerInfo, fileHash []byte, output commandOutput) (success bool) {
 	// check if the file exists locally
 	_, fileSizeLocal, status, _ := peer.Backend.UserWarehouse.FileExists(fileHash)
 	if status != warehouse.StatusOK {
-		fmt.Fprintf(output, "File does not exist in local warehouse: %s\n", hex.EncodeToString(fileHash))
+		output.errorf("File does not exist in local warehouse: %s\n", hex.EncodeToString(fileHash))
 		return
 	}
 
 	// peer must be connected
 	if !peer.IsConnectionActive() {
-		fmt.Fprintf(output, "Peer has no active connection: %s\n", hex.EncodeToString(peer.NodeID))
+		output.errorf("Peer has no active connection: %s\n", hex.EncodeToString(peer.NodeID))
 		return
 	}
 
-	fmt.Fprintf(output, "1. Peer connected: %s\n", hex.EncodeToString(peer.NodeID))
+	output.textf("1. Peer connected: %s\n", hex.EncodeToString(peer.NodeID))
+	if output.JSON {
+		output.writeJSON(jsonProbeStatus{Status: "connected", NodeID: hex.EncodeToString(peer.NodeID)})
+	}
 
 	// request file transfer
 	udtConn, virtualConn, err := peer.FileTransferRequestUDT(fileHash, 0, 0)
 	if err != nil {
-		fmt.Fprintf(output, "Error opening UDT connection: %s\n", err)
+		output.errorf("Error opening UDT connection: %s\n", err)
 		return
 	}
 	defer udtConn.Close()
 
-	fmt.Fprintf(output, "2. Opened UDT connection for file: %s\n", hex.EncodeToString(fileHash))
+	output.textf("2. Opened UDT connection for file: %s\n", hex.EncodeToString(fileHash))
 
 	fileSize, transferSize, err := protocol.FileTransferReadHeader(udtConn)
 	if err != nil {
-		fmt.Fprintf(output, "Error reading file transfer header: %s\n", err)
+		output.errorf("Error reading file transfer header: %s\n", err)
 		return
 	}
 	virtualConn.Stats.(*core.FileTransferStats).FileSize = fileSize
 
 	if fileSize != fileSizeLocal {
-		fmt.Fprintf(output, "Error expected local file size %d mismatch with remote file size %d\n", fileSizeLocal, fileSize)
+		output.errorf("Error expected local file size %d mismatch with remote file size %d\n", fileSizeLocal, fileSize)
 		return
 	} else if fileSize != transferSize {
-		fmt.Fprintf(output, "Error remote peer only offering %d of total file size %d\n", transferSize, fileSize)
+		output.errorf("Error remote peer only offering %d of total file size %d\n", transferSize, fileSize)
 		return
 	}
 
-	fmt.Fprintf(output, "3. Matching transfer size %d and file size %d\n", transferSize, fileSizeLocal)
+	output.textf("3. Matching transfer size %d and file size %d\n", transferSize, fileSizeLocal)
+	if output.JSON {
+		output.writeJSON(jsonProbeStatus{Status: "opened", FileHash: hex.EncodeToString(fileHash), FileSize: fileSize})
+	}
+
+	result := jsonProbeResult{FileHash: hex.EncodeToString(fileHash), FileSize: fileSize}
 
 	// Previous: Loop in explicitly 512 bytes (which is the same buffer as io.Copy apparently) and compare with what is expected.
 	// Now use 4 KB buffer.
@@ -73,6 +128,7 @@ func transferCompareFile(peer *core.PeerInfo, fileHash []byte, output io.Writer)
 	timeStart := time.Now()
 	timeUpdateLast := time.Now()
 	dataRemaining := fileSize
+	matching := true
 
 	for {
 		maxSize := uint64(4096)
@@ -88,13 +144,15 @@ func transferCompareFile(peer *core.PeerInfo, fileHash []byte, output io.Writer)
 		data = data[:n]
 
 		if err != nil {
-			fmt.Fprintf(output, "-- TERMINATE: ERROR READING. Read %d bytes. Total read %d : %v\n", n, fileOffset+n, err)
+			output.textf("-- TERMINATE: ERROR READING. Read %d bytes. Total read %d : %v\n", n, fileOffset+n, err)
+			result.Error = err.Error()
 			break
 		} else if n == 0 {
-			fmt.Fprintf(output, "-- TERMINATE: EMPTY READ but no error indicated. Read %d bytes. Total read %d : %v\n", n, fileOffset+n, err)
+			output.textf("-- TERMINATE: EMPTY READ but no error indicated. Read %d bytes. Total read %d : %v\n", n, fileOffset+n, err)
+			result.Error = "empty read"
 			break
 		} else if dataRemaining <= 0 {
-			fmt.Fprintf(output, "-- TERMINATE: EVERYTHING READ. Read %d bytes. Total read %d : %v\n", n, fileOffset+n, err)
+			output.textf("-- TERMINATE: EVERYTHING READ. Read %d bytes. Total read %d : %v\n", n, fileOffset+n, err)
 			timeUpdateLast = time.Now()
 			break
 		}
@@ -104,19 +162,25 @@ func transferCompareFile(peer *core.PeerInfo, fileHash []byte, output io.Writer)
 		compareBuffer := bytes.NewBuffer(dataCompare)
 		_, bytesRead, err := peer.Backend.UserWarehouse.ReadFile(fileHash, int64(fileOffset), int64(n), compareBuffer)
 		if err != nil {
-			fmt.Fprintf(output, "Warehouse error reading at offset %d length %d: %v\n", fileOffset, n, err)
+			output.textf("Warehouse error reading at offset %d length %d: %v\n", fileOffset, n, err)
+			result.Error = fmt.Sprintf("warehouse error reading at offset %d length %d: %v", fileOffset, n, err)
+			matching = false
 			break
 		} else if int(bytesRead) != n {
-			fmt.Fprintf(output, "Warehouse did not read full data. Requested %d, provided %d.\n", n, bytesRead)
+			output.textf("Warehouse did not read full data. Requested %d, provided %d.\n", n, bytesRead)
+			result.Error = fmt.Sprintf("warehouse did not read full data, requested %d, provided %d", n, bytesRead)
+			matching = false
 			break
 		}
 		dataCompare = compareBuffer.Bytes()
 
 		// make the comparison
 		if !bytes.Equal(data, dataCompare) {
-			fmt.Fprintf(output, "Offset %08X   read %d   DATA MISMATCH:\n", fileOffset, n)
-			fmt.Fprintf(output, "---- DATA FROM REMOTE:\n%s\n", hex.Dump(data))
-			fmt.Fprintf(output, "---- DATA FROM LOCAL WAREHOUSE:\n%s\n", hex.Dump(dataCompare))
+			output.textf("Offset %08X   read %d   DATA MISMATCH:\n", fileOffset, n)
+			output.textf("---- DATA FROM REMOTE:\n%s\n", hex.Dump(data))
+			output.textf("---- DATA FROM LOCAL WAREHOUSE:\n%s\n", hex.Dump(dataCompare))
+			result.MismatchOffset, result.MismatchRemote, result.MismatchLocal = fileOffset, hex.EncodeToString(data), hex.EncodeToString(dataCompare)
+			matching = false
 
 			break
 		}
@@ -125,7 +189,11 @@ func transferCompareFile(peer *core.PeerInfo, fileHash []byte, output io.Writer)
 		//fmt.Fprintf(output, "Offset %08X   read %d   SUCCESS\n", fileOffset, n)
 		if time.Now().After(timeUpdateLast.Add(time.Second)) {
 			speed := float64(totalRead-totalReadLast) / time.Since(timeUpdateLast).Seconds() / 1024
-			fmt.Fprintf(output, "Offset %08X   progress %.2f %%   MATCHING. Speed: %.2f KB/s\n", fileOffset, float64((fileOffset+n)*100)/float64(fileSize), speed)
+			progress := float64((fileOffset+n)*100) / float64(fileSize)
+			output.textf("Offset %08X   progress %.2f %%   MATCHING. Speed: %.2f KB/s\n", fileOffset, progress, speed)
+			if output.JSON {
+				output.writeJSON(jsonProbeStatus{Status: "progress", Offset: fileOffset, Progress: progress, Speed: speed})
+			}
 
 			timeUpdateLast = time.Now()
 			totalReadLast = totalRead
@@ -134,19 +202,34 @@ func transferCompareFile(peer *core.PeerInfo, fileHash []byte, output io.Writer)
 		fileOffset += n
 	}
 
-	fmt.Fprintf(output, "Terminate reason %d: %s\n", virtualConn.GetTerminateReason(), translateTerminateReason(virtualConn.GetTerminateReason()))
+	output.textf("Terminate reason %d: %s\n", virtualConn.GetTerminateReason(), translateTerminateReason(virtualConn.GetTerminateReason()))
 
 	speed := float64(totalRead) / timeUpdateLast.Sub(timeStart).Seconds() / 1024
 
-	fmt.Fprintf(output, "Transfer took %s. Average speed is %.2f KB/s\n", timeUpdateLast.Sub(timeStart).String(), speed)
+	output.textf("Transfer took %s. Average speed is %.2f KB/s\n", timeUpdateLast.Sub(timeStart).String(), speed)
 
 	if totalRead != int(fileSizeLocal) {
-		fmt.Fprintf(output, "Error transferred data %d mismatch with reported file size %d\n", totalRead, fileSize)
+		output.textf("Error transferred data %d mismatch with reported file size %d\n", totalRead, fileSize)
+	} else {
+		output.textf("Finished reading total of %d bytes. Expected %d bytes.\n", totalRead, fileSize)
+	}
+
+	success = matching && totalRead == int(fileSizeLocal)
+
+	if output.JSON {
+		result.Transferred = totalRead
+		result.Matching = success
+		result.TerminateReason = virtualConn.GetTerminateReason()
+		result.TerminateReasonText = translateTerminateReason(result.TerminateReason)
+		result.Duration = timeUpdateLast.Sub(timeStart).Seconds()
+		result.Speed = speed
+		result.Metrics = metricsToJSON(udtConn.Metrics)
+		output.writeJSON(result)
 	} else {
-		fmt.Fprintf(output, "Finished reading total of %d bytes. Expected %d bytes.\n", totalRead, fileSize)
+		outputUDTMetrics(udtConn.Metrics, output)
 	}
 
-	outputUDTMetrics(udtConn.Metrics, output)
+	return success
 }
 
 func translateTerminateReason(reason int) string {
@@ -159,6 +242,8 @@ func translateTerminateReason(reason int) string {
 		return "Remote termination signal (upstream)"
 	case 3:
 		return "Sequence invalidation or expiration (upstream)"
+	case transferReasonShutdown:
+		return "Cancelled due to shutdown of this application."
 
 	case udt.TerminateReasonListenerClosed:
 		return "Listener: The listener.Close function was called."
@@ -7,6 +7,7 @@ Author:     Peter Kleissner
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -14,24 +15,66 @@ import (
 	"github.com/google/uuid"
 )
 
-const configFile = "Config.yaml"
 const appName = "Peernet Cmd"
 
-var config struct {
-	// Warning: These settings are currently overwritten (deleted) when the config file is updated by core.
-	// In the future the core package will consider custom config fields.
+// Exit codes specific to this application in addition to the ones defined by core.
+const (
+	ExitCommandFailed       = 20 // One or more commands executed via -exec or -script failed.
+	ExitScriptRead          = 21 // Error reading the script file specified via -script.
+	ExitWaitPeersTimeout    = 22 // Timeout waiting for the count of peers specified via -waitpeers.
+	ExitParamOutputInvalid  = 23 // Parameter for output is invalid.
+	ExitShutdownInterrupted = 24 // Graceful shutdown completed, but active transfers or API requests were interrupted after the shutdown timeout.
+	ExitPIDFile             = 25 // Error writing the PID file in daemon mode.
+	ExitRestartFailed       = 26 // Error starting the application again after a restart was requested.
+	ExitAPISettingsInvalid  = 27 // API settings are invalid.
+	ExitEnvironmentInvalid  = 28 // Environment variable overriding a setting is invalid.
+	ExitCmdConfigInvalid    = 29 // Error reading, migrating, or validating the Cmd settings file.
+	ExitAuditLog            = 30 // Error opening the audit log.
+)
 
+// cmdConfig contains the settings of this application. They are stored in the Cmd settings file separate from the config file of core, see Config.go.
+type cmdConfig struct {
 	// API settings
-	APIListen          []string  `yaml:"APIListen"`          // WebListen is in format IP:Port and declares where the web-interface should listen on. IP can also be ommitted to listen on any.
-	APIUseSSL          bool      `yaml:"APIUseSSL"`          // Enables SSL.
-	APICertificateFile string    `yaml:"APICertificateFile"` // This is the certificate received from the CA. This can also include the intermediate certificate from the CA.
-	APICertificateKey  string    `yaml:"APICertificateKey"`  // This is the private key.
-	APITimeoutRead     string    `yaml:"APITimeoutRead"`     // The maximum duration for reading the entire request, including the body.
-	APITimeoutWrite    string    `yaml:"APITimeoutWrite"`    // The maximum duration before timing out writes of the response. This includes processing time and is therefore the max time any HTTP function may take.
-	APIKey             uuid.UUID `yaml:"APIKey"`             // API key. Empty UUID 00000000-0000-0000-0000-000000000000 = not used.
-	DebugAPI           bool      `yaml:"DebugAPI"`           // Enables the debug API which allows profiling. Do not enable in production. Only available if compiled with debug tag.
+	APIListen          []string       `yaml:"APIListen"`          // WebListen is in format IP:Port and declares where the web-interface should listen on. IP can also be ommitted to listen on any. Unix domain sockets are specified as unix:/path.
+	APIUseSSL          bool           `yaml:"APIUseSSL"`          // Enables SSL.
+	APICertificateFile string         `yaml:"APICertificateFile"` // This is the certificate received from the CA. This can also include the intermediate certificate from the CA.
+	APICertificateKey  string         `yaml:"APICertificateKey"`  // This is the private key.
+	APITimeoutRead     string         `yaml:"APITimeoutRead"`     // The maximum duration for reading the entire request, including the body.
+	APITimeoutWrite    string         `yaml:"APITimeoutWrite"`    // The maximum duration before timing out writes of the response. This includes processing time and is therefore the max time any HTTP function may take.
+	APIKey             uuid.UUID      `yaml:"APIKey"`             // API key with admin scope. Empty UUID 00000000-0000-0000-0000-000000000000 = not used.
+	APIKeys            []apiKeyConfig `yaml:"APIKeys"`            // Named API keys with scopes, in addition to APIKey.
+	DebugAPI           bool           `yaml:"DebugAPI"`           // Enables the debug API which allows profiling. Do not enable in production. Only available if compiled with debug tag.
+
+	// Browser and client restrictions
+	APIAllowedOrigins    []string `yaml:"APIAllowedOrigins"`    // Origins allowed to access /console and the endpoints of this application from a browser, for example "http://localhost:3000". Other cross-origin requests are refused.
+	APIRefuseKeyInParam  bool     `yaml:"APIRefuseKeyInParam"`  // Refuse API keys in the k parameter of the URL. Keys must then be provided via the x-api-key header.
+	APIKeyInParamClients []string `yaml:"APIKeyInParamClients"` // Names of API keys that may still provide the key in the k parameter if APIRefuseKeyInParam is set. The key via APIKey is named "APIKey".
+
+	// Unix domain sockets via listen addresses in the format unix:/path
+	APISocketMode  string `yaml:"APISocketMode"`  // File mode of the socket in octal format. Default "0600" = only the owner may connect.
+	APISocketOwner string `yaml:"APISocketOwner"` // Owner of the socket in the format user[:group]. Empty = not changed.
+	APISocketNoKey bool   `yaml:"APISocketNoKey"` // Requests via sockets do not require an API key and have the admin scope. Access is only protected by the file permissions.
+
+	// Brute-force protection of the API key authentication
+	APIAuthMaxFailures int    `yaml:"APIAuthMaxFailures"` // Count of failed attempts from a remote address after which it is locked out. 0 = default of 5.
+	APIAuthBackoff     string `yaml:"APIAuthBackoff"`     // Time a remote address must wait after the first failed attempt. It doubles with each further failure. Default 1s.
+	APIAuthLockout     string `yaml:"APIAuthLockout"`     // Duration of the lockout. Default 15m.
+
+	// Audit log of API calls and console commands
+	AuditLog         string `yaml:"AuditLog"`         // Audit log file. Empty = default next to the config file, for example "Config.audit.log". "none" disables the audit log.
+	AuditLogMaxSize  int    `yaml:"AuditLogMaxSize"`  // Maximum size of the audit log file in MB before it is rotated. 0 = default of 10 MB.
+	AuditLogMaxFiles int    `yaml:"AuditLogMaxFiles"` // Count of rotated audit log files to keep. 0 = default of 5.
+
+	ShutdownTimeout string `yaml:"ShutdownTimeout"` // Maximum time to wait for active API requests and transfers during graceful shutdown. Default 30s.
+
+	// Thresholds for the /ready API
+	ReadyMinPeers        int  `yaml:"ReadyMinPeers"`        // Minimum count of peers. 0 = default of 1.
+	ReadyRequireRootPeer bool `yaml:"ReadyRequireRootPeer"` // Whether a root peer must be connected.
 }
 
+// config contains the effective settings, which are the settings from the config file with environment variables applied.
+var config cmdConfig
+
 func main() {
 	userAgent := appName + "/" + core.Version
 
@@ -46,7 +89,30 @@ func main() {
 		MessageOutPong:         filterMessageOutPong,
 	}
 
-	backend, status, err := core.Init(userAgent, configFile, filters, &config)
+	params := parseCmdParams()
+
+	// After a restart on Windows the previous instance may still be running.
+	restartWaitPrevious()
+
+	// The settings must be loaded before core is initialized. Core may save its config file during initialization, which deletes the
+	// settings of this application stored there by previous versions before they are migrated.
+	loaded, migrated, err := configLoad(configCmdFile, configFile)
+	if err != nil {
+		fmt.Printf("Error in settings file '%s': %s\n", configCmdFile, err.Error())
+		os.Exit(ExitCmdConfigInvalid)
+	}
+
+	if config, configEnvironment, err = configApplyEnvironment(loaded); err != nil {
+		fmt.Printf("Error in environment variables: %s\n", err.Error())
+		os.Exit(ExitEnvironmentInvalid)
+	} else if err = configValidate(&config); err != nil {
+		// The settings file itself is validated by configLoad, therefore the error is caused by an environment variable.
+		fmt.Printf("Error in settings overridden by environment variables: %s\n", err.Error())
+		os.Exit(ExitEnvironmentInvalid)
+	}
+	configParams = &params
+
+	backend, status, err := core.Init(userAgent, configFile, filters, nil)
 
 	if status != core.ExitSuccess {
 		switch status {
@@ -64,14 +130,60 @@ func main() {
 		os.Exit(status)
 	}
 
-	backend.Stdout.Subscribe(os.Stdout)
+	if migrated {
+		backend.LogError("main", "migrated settings from config file '%s' to settings file '%s'\n", configFile, configCmdFile)
+	}
+
+	if params.Daemon {
+		if err := daemonStart(backend, params.PIDFile); err != nil {
+			backend.LogError("main", "error writing PID file '%s': %v\n", params.PIDFile, err)
+			os.Exit(ExitPIDFile)
+		}
+	} else if params.OutputJSON {
+		// Backend output such as log lines and incoming chat messages is not JSON. It is written to stderr so it does not break parsing of the output.
+		backend.Stdout.Subscribe(os.Stderr)
+	} else {
+		backend.Stdout.Subscribe(os.Stdout)
+	}
+
+	if err := auditStart(config.AuditLog, config.AuditLogMaxSize, config.AuditLogMaxFiles); err != nil {
+		fmt.Printf("Error opening audit log '%s': %s\n", config.AuditLog, err.Error())
+		os.Exit(ExitAuditLog)
+	}
+
+	if err := startAPI(backend, &params); errors.Is(err, errAPIServe) {
+		// The details are logged by apiServe. The application continues to run, as with other listen errors.
+		fmt.Printf("%s\n", err.Error())
+	} else if err != nil {
+		backend.LogError("main", "error in API settings: %v\n", err)
+		fmt.Printf("Error in API settings: %s\n", err.Error())
+		os.Exit(ExitAPISettingsInvalid)
+	}
 
-	apiListen, apiKey, watchPID := parseCmdParams()
-	startAPI(backend, apiListen, apiKey)
+	if _, err := parseDuration(config.ShutdownTimeout); err != nil {
+		backend.LogError("main", "invalid ShutdownTimeout '%s', using default %s: %v\n", config.ShutdownTimeout, shutdownTimeoutDefault.String(), err)
+	}
 
-	go processExitMonitor(backend, watchPID)
+	go processExitMonitor(backend, params.WatchPID)
+	go signalMonitor(backend, &params)
 
 	backend.Connect()
 
-	userCommands(backend, os.Stdin, os.Stdout, nil)
+	if params.Exec != "" || params.Script != "" {
+		os.Exit(runBatch(backend, &params))
+	}
+
+	if params.Daemon {
+		if err := sdNotify("READY=1"); err != nil {
+			backend.LogError("main", "error notifying service manager: %v\n", err)
+		}
+
+		// Run until the application is shut down.
+		select {}
+	}
+
+	userCommands(shutdownContext, backend, readLines(shutdownContext, os.Stdin), os.Stdout, params.OutputJSON)
+
+	// The standard input is closed or the shutdown is in progress. Continue running until the application exits.
+	select {}
 }
@@ -0,0 +1,68 @@
+/*
+File Name:  Main_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Shared setup of the tests.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/PeernetOfficial/core"
+)
+
+var testBackendOnce sync.Once
+var testBackendInstance *core.Backend
+var testDataFolder string
+
+// TestMain removes the data folder of the test backend after all tests ran.
+func TestMain(m *testing.M) {
+	code := m.Run()
+
+	if testDataFolder != "" {
+		os.RemoveAll(testDataFolder)
+	}
+
+	os.Exit(code)
+}
+
+// testBackend returns a backend for tests. It is initialized once with a config in a temporary folder. It only listens on localhost and does not connect to the network.
+func testBackend(t *testing.T) *core.Backend {
+	testBackendOnce.Do(func() {
+		var err error
+		if testDataFolder, err = os.MkdirTemp("", "peernet-cmd-test"); err != nil {
+			t.Fatal(err)
+		}
+
+		folder := filepath.ToSlash(testDataFolder) + "/"
+		configData := "LogFile: \"" + folder + "log backend.txt\"\n" +
+			"BlockchainMain: \"" + folder + "blockchain main/\"\n" +
+			"WarehouseMain: \"" + folder + "warehouse main/\"\n" +
+			"DataFolder: \"" + folder + "\"\n" +
+			"Listen: [\"127.0.0.1:0\"]\n" +
+			"EnableUPnP: false\n" +
+			"AutoUpdateSeedList: false\n"
+
+		configFilename := filepath.Join(testDataFolder, "Config.yaml")
+		if err = os.WriteFile(configFilename, []byte(configData), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		backend, status, err := core.Init(appName+"/test", configFilename, nil, nil)
+		if status != core.ExitSuccess {
+			t.Fatalf("error initializing backend: status %d: %v", status, err)
+		}
+		testBackendInstance = backend
+	})
+
+	if testBackendInstance == nil {
+		t.Fatal("test backend not initialized")
+	}
+	return testBackendInstance
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+/*
+File Name:  Process Monitor unix.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Monitoring of arbitrary processes on Unix. Waiting via wait() only works for child processes, therefore the process is probed periodically.
+*/
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// processProbeInterval is the interval for checking whether a monitored process is still running.
+const processProbeInterval = time.Second
+
+// processExists checks if the process exists by sending the null signal. EPERM means the process exists but belongs to another user.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// processWaitExit blocks until the process exits. Note that if the process ID is reused by a new process in between two probes, the exit is not detected.
+func processWaitExit(pid int) (err error) {
+	for processExists(pid) {
+		time.Sleep(processProbeInterval)
+	}
+
+	return nil
+}
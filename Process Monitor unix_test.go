@@ -0,0 +1,111 @@
+//go:build !windows
+// +build !windows
+
+/*
+File Name:  Process Monitor unix_test.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestProcessHelper is not a real test. It is started as helper process by TestProcessWaitExit.
+// As intermediate it starts the target process, prints its process ID and exits so that the target is not a child of the test process. As target it runs until it is killed.
+func TestProcessHelper(t *testing.T) {
+	switch os.Getenv("PEERNET_TEST_HELPER_PROCESS") {
+	case "intermediate":
+		target := exec.Command(os.Args[0], "-test.run=^TestProcessHelper$")
+		target.Env = append(os.Environ(), "PEERNET_TEST_HELPER_PROCESS=target")
+		if err := target.Start(); err != nil {
+			fmt.Fprintf(os.Stderr, "error starting target process: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(target.Process.Pid)
+		os.Exit(0)
+
+	case "target":
+		time.Sleep(time.Hour)
+
+	default:
+		t.Skip("only used as helper process")
+	}
+}
+
+// TestProcessWaitExit starts a process that is not a child of the test process, kills it, and checks that the exit is detected within the probe interval.
+func TestProcessWaitExit(t *testing.T) {
+	intermediate := exec.Command(os.Args[0], "-test.run=^TestProcessHelper$")
+	intermediate.Env = append(os.Environ(), "PEERNET_TEST_HELPER_PROCESS=intermediate")
+	out, err := intermediate.Output()
+	if err != nil {
+		t.Fatalf("error running intermediate process: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		t.Fatalf("invalid target process ID %q: %v", out, err)
+	}
+
+	// The intermediate process has exited. The target is orphaned and reaped by init (or a subreaper), not by this process.
+	if ppid := processParent(pid); ppid == os.Getpid() {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Fatalf("target process %d is a child of the test process", pid)
+	}
+
+	if !processExists(pid) {
+		t.Fatalf("target process %d not detected as running", pid)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- processWaitExit(pid) }()
+
+	select {
+	case err := <-exited:
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Fatalf("exit detected while target process is running: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		t.Fatalf("error killing target process: %v", err)
+	}
+	killed := time.Now()
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("error waiting for exit: %v", err)
+		}
+		t.Logf("exit detected after %s", time.Since(killed))
+	case <-time.After(5 * processProbeInterval):
+		t.Fatalf("exit not detected within %s", 5*processProbeInterval)
+	}
+
+	if processExists(pid) {
+		t.Fatalf("target process %d still reported as existing after exit", pid)
+	}
+}
+
+// processParent returns the parent process ID of the process, or 0 if it cannot be determined on this platform.
+func processParent(pid int) int {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return 0
+	}
+	// The second field is the command name in parentheses which may contain spaces; the parent ID is the second field after it.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	if len(fields) < 2 {
+		return 0
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	return ppid
+}
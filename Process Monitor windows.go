@@ -0,0 +1,38 @@
+//go:build windows
+// +build windows
+
+/*
+File Name:  Process Monitor windows.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Monitoring of arbitrary processes on Windows. The process handle can be waited on for any process, not only child processes.
+*/
+
+package main
+
+import (
+	"os"
+)
+
+// processExists checks if the process exists by opening a handle to it.
+func processExists(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	process.Release()
+	return true
+}
+
+// processWaitExit blocks until the process exits.
+func processWaitExit(pid int) (err error) {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	_, err = process.Wait()
+	return err
+}
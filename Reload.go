@@ -0,0 +1,152 @@
+/*
+File Name:  Reload.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Reloading of settings from the config file without restarting the application. Peer connections are not affected.
+*/
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/PeernetOfficial/core"
+)
+
+var reloadMutex sync.Mutex
+
+// reloadSettings re-reads the config file and the Cmd settings file and applies the API and log settings. API settings provided via command line override the reloaded settings.
+// If the Cmd settings file cannot be read or the settings are invalid, the current API settings remain active.
+// An error is only returned if the reloaded settings were not applied. If only the new log file cannot be opened, the error is logged and the previous log file remains in use.
+func reloadSettings(backend *core.Backend, params *cmdParams) (err error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	var reloadedCore core.Config
+	if status, err := core.LoadConfig(backend.ConfigFilename, &reloadedCore); status != core.ExitSuccess {
+		backend.LogError("reloadSettings", "error reading config file '%s' (status %d): %v\n", backend.ConfigFilename, status, err)
+		return err
+	}
+
+	reloaded, _, err := configLoad(configCmdFile, backend.ConfigFilename)
+	if err != nil {
+		backend.LogError("reloadSettings", "error reading settings file '%s': %v\n", configCmdFile, err)
+		return err
+	}
+
+	if errLog := reloadLog(backend, &reloadedCore); errLog != nil {
+		backend.LogError("reloadSettings", "error opening log file '%s', keeping current log file: %v\n", reloadedCore.LogFile, errLog)
+	}
+
+	effective, environment, errAPI := configApplyEnvironment(reloaded)
+	if errAPI == nil {
+		errAPI = configValidate(&effective)
+	}
+	if errAPI == nil {
+		_, errAPI = params.apiSettings(&effective)
+	}
+	if errAPI != nil {
+		backend.LogError("reloadSettings", "error in API settings, keeping current API settings: %v\n", errAPI)
+		return errAPI
+	}
+
+	if errAPI = reloadAPI(backend, &effective, params); errAPI != nil {
+		return errAPI
+	}
+
+	configMutex.Lock()
+	configEnvironment = environment
+	configMutex.Unlock()
+
+	return nil
+}
+
+// reloadLog applies the log settings. If the log file changed, subsequent log messages are written to the new file.
+func reloadLog(backend *core.Backend, reloaded *core.Config) (err error) {
+	if reloaded.LogFile != "" && reloaded.LogFile != backend.Config.LogFile {
+		if directory, _ := path.Split(reloaded.LogFile); directory != "" {
+			os.MkdirAll(directory, os.ModePerm)
+		}
+
+		logFile, err := os.OpenFile(reloaded.LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+
+		// The previous log file is closed after switching, as the logger does not write to it anymore.
+		previous := log.Writer()
+		log.SetOutput(logFile)
+		if file, ok := previous.(*os.File); ok && file != os.Stdout && file != os.Stderr {
+			file.Close()
+		}
+
+		backend.Config.LogFile = reloaded.LogFile
+	}
+
+	backend.Config.LogTarget = daemonLogTarget(reloaded.LogTarget)
+
+	return nil
+}
+
+// reloadAPI restarts the API servers with the reloaded API settings. Console sessions remain connected.
+// The reloaded settings must be valid and include the environment variables.
+// If the API cannot be started with the reloaded settings, for example because an address is already in use, the previous API settings are restored and the error is returned.
+func reloadAPI(backend *core.Backend, reloaded *cmdConfig, params *cmdParams) (err error) {
+	// Active requests may complete until the shutdown timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+
+	if interrupted := apiStop(ctx); interrupted > 0 {
+		backend.LogError("reloadAPI", "%d API servers closed forcefully\n", interrupted)
+	}
+
+	configMutex.Lock()
+	previous := config
+	reloadAPISettings(&config, reloaded)
+	configMutex.Unlock()
+
+	if err = startAPI(backend, params); err == nil {
+		return nil
+	}
+
+	backend.LogError("reloadAPI", "error starting API with reloaded settings, restoring previous API settings: %v\n", err)
+
+	// Servers that were started with the reloaded settings have no active requests yet.
+	apiStop(ctx)
+
+	configMutex.Lock()
+	reloadAPISettings(&config, &previous)
+	configMutex.Unlock()
+
+	if errRestore := startAPI(backend, params); errRestore != nil {
+		backend.LogError("reloadAPI", "error restoring previous API settings: %v\n", errRestore)
+	}
+
+	return err
+}
+
+// reloadAPISettings copies the API settings.
+func reloadAPISettings(target, reloaded *cmdConfig) {
+	target.APIListen = reloaded.APIListen
+	target.APIUseSSL = reloaded.APIUseSSL
+	target.APICertificateFile = reloaded.APICertificateFile
+	target.APICertificateKey = reloaded.APICertificateKey
+	target.APITimeoutRead = reloaded.APITimeoutRead
+	target.APITimeoutWrite = reloaded.APITimeoutWrite
+	target.APIKey = reloaded.APIKey
+	target.APIKeys = reloaded.APIKeys
+	target.APIAllowedOrigins = reloaded.APIAllowedOrigins
+	target.APIRefuseKeyInParam = reloaded.APIRefuseKeyInParam
+	target.APIKeyInParamClients = reloaded.APIKeyInParamClients
+	target.APISocketMode = reloaded.APISocketMode
+	target.APISocketOwner = reloaded.APISocketOwner
+	target.APISocketNoKey = reloaded.APISocketNoKey
+	target.APIAuthMaxFailures = reloaded.APIAuthMaxFailures
+	target.APIAuthBackoff = reloaded.APIAuthBackoff
+	target.APIAuthLockout = reloaded.APIAuthLockout
+}
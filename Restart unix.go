@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+/*
+File Name:  Restart unix.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// processRestart replaces the current process with a new instance of the same executable and parameters. The process ID remains the same, which
+// is required by service managers. It only returns in case of error.
+func processRestart() (err error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	return syscall.Exec(executable, os.Args, os.Environ())
+}
+
+// restartWaitPrevious does nothing on Unix, since the previous instance is replaced by processRestart.
+func restartWaitPrevious() {
+}
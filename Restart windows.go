@@ -0,0 +1,69 @@
+//go:build windows
+// +build windows
+
+/*
+File Name:  Restart windows.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// restartEnvironmentPID passes the process ID of the previous instance to the new instance.
+const restartEnvironmentPID = "PEERNET_CMD_RESTART_PID"
+
+// restartWaitTimeout is the maximum time the new instance waits for the previous instance to exit.
+const restartWaitTimeout = time.Minute
+
+// processRestart starts a new instance of the same executable and parameters. Windows does not support replacing the current process,
+// therefore the new process has a different process ID. The caller must exit the current process afterwards.
+// The new instance waits for the current process to exit before it initializes, see restartWaitPrevious.
+func processRestart() (err error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	environment := append(os.Environ(), restartEnvironmentPID+"="+strconv.Itoa(os.Getpid()))
+
+	process, err := os.StartProcess(executable, os.Args, &os.ProcAttr{Env: environment, Files: []*os.File{os.Stdin, os.Stdout, os.Stderr}})
+	if err != nil {
+		return err
+	}
+
+	return process.Release()
+}
+
+// restartWaitPrevious waits for the previous instance to exit if this process was started by processRestart.
+// Until it exits, the previous instance holds the API listen addresses and the database files. It must be called before the backend is initialized.
+func restartWaitPrevious() {
+	text, ok := os.LookupEnv(restartEnvironmentPID)
+	if !ok {
+		return
+	}
+	os.Unsetenv(restartEnvironmentPID)
+
+	pid, err := strconv.Atoi(text)
+	if err != nil {
+		return
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		processWaitExit(pid)
+		close(exited)
+	}()
+
+	select {
+	case <-exited:
+	case <-time.After(restartWaitTimeout):
+		fmt.Printf("Previous instance with process ID %d did not exit within %s, continuing startup.\n", pid, restartWaitTimeout.String())
+	}
+}
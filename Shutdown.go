@@ -0,0 +1,151 @@
+/*
+File Name:  Shutdown.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Graceful shutdown of the application. The API and console sessions are stopped first, then active transfers may complete until the deadline.
+Remaining transfers are cancelled before the process exits.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/PeernetOfficial/core"
+	"github.com/PeernetOfficial/core/udt"
+)
+
+// shutdownTimeoutDefault is the default maximum time to wait for active API requests and transfers during shutdown.
+const shutdownTimeoutDefault = 30 * time.Second
+
+// transferReasonShutdown is the reason code for transfers that are cancelled due to shutdown before their UDT session is established. It must not collide with the codes used by core, see translateTerminateReason.
+const transferReasonShutdown = 5
+
+// shutdownContext is cancelled when the shutdown starts. Console sessions derive their context from it and end immediately.
+var shutdownContext, shutdownCancel = context.WithCancel(context.Background())
+
+// shutdownState is 0 if running and 1 if a shutdown is in progress.
+var shutdownState int32
+
+// shutdownStatus reports what was interrupted by the shutdown.
+type shutdownStatus struct {
+	APIServersInterrupted int // Count of API servers that were closed forcefully because requests did not complete in time.
+	TransfersActive       int // Count of transfers active when the shutdown started.
+	TransfersInterrupted  int // Count of transfers that were cancelled because they did not complete in time.
+}
+
+// shutdownApplication gracefully shuts down the application and exits the process. The reason is logged.
+// If restart is set, the application is started again with the same parameters after the shutdown.
+// If a shutdown is already in progress, it returns false immediately. Otherwise it does not return.
+func shutdownApplication(backend *core.Backend, reason string, restart bool) bool {
+	if !atomic.CompareAndSwapInt32(&shutdownState, 0, 1) {
+		return false
+	}
+
+	backend.LogError("shutdownApplication", "graceful shutdown (restart %t): %s\n", restart, reason)
+	if restart {
+		sdNotify("RELOADING=1")
+	} else {
+		sdNotify("STOPPING=1")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+
+	var status shutdownStatus
+
+	// Stop accepting new API requests and console sessions. Active console sessions are terminated.
+	shutdownCancel()
+	status.APIServersInterrupted = apiStop(ctx)
+
+	// Active transfers may complete until the deadline.
+	status.TransfersActive = len(activeTransfers(backend))
+	status.TransfersInterrupted = shutdownTransfers(ctx, backend)
+
+	daemonStop()
+
+	backend.LogError("shutdownApplication", "shutdown complete: %d of %d transfers interrupted, %d API servers closed forcefully\n", status.TransfersInterrupted, status.TransfersActive, status.APIServersInterrupted)
+
+	if restart {
+		// On success processRestart only returns if the new process was started separately.
+		if err := processRestart(); err != nil {
+			backend.LogError("shutdownApplication", "error restarting: %v\n", err)
+			os.Exit(ExitRestartFailed)
+		}
+	}
+
+	if status.TransfersInterrupted > 0 || status.APIServersInterrupted > 0 {
+		os.Exit(ExitShutdownInterrupted)
+	}
+
+	os.Exit(core.ExitGraceful)
+	return true
+}
+
+// shutdownTimeout returns the maximum time to wait for active API requests and transfers as set in the config.
+// If the setting is not set or invalid, the default is used. Invalid settings are reported at startup.
+func shutdownTimeout() time.Duration {
+	timeout, err := parseDuration(config.ShutdownTimeout)
+	if err != nil || config.ShutdownTimeout == "" {
+		return shutdownTimeoutDefault
+	}
+	return timeout
+}
+
+// shutdownInProgress checks if the shutdown was initiated.
+func shutdownInProgress() bool {
+	return atomic.LoadInt32(&shutdownState) != 0
+}
+
+// shutdownTransfers waits for active transfers to complete until the context expires. Remaining transfers are cancelled by closing their UDT connections, which sends the termination message to the remote peer.
+// It returns the count of cancelled transfers.
+func shutdownTransfers(ctx context.Context, backend *core.Backend) (interrupted int) {
+	for {
+		active := activeTransfers(backend)
+		if len(active) == 0 {
+			return 0
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, virtualConn := range active {
+				if udtConn := transferUDTConn(virtualConn); udtConn != nil {
+					udtConn.Close()
+				} else {
+					// The UDT session is not yet established, there is nothing to terminate on the protocol level.
+					virtualConn.Close(transferReasonShutdown)
+				}
+			}
+
+			return len(active)
+
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// activeTransfers returns the virtual connections of all transfers that are not terminated.
+func activeTransfers(backend *core.Backend) (active []*core.VirtualPacketConn) {
+	for _, liteSession := range backend.LiteSessions() {
+		if virtualConn, ok := liteSession.Data.(*core.VirtualPacketConn); ok && !virtualConn.IsTerminated() {
+			active = append(active, virtualConn)
+		}
+	}
+
+	return active
+}
+
+// transferUDTConn returns the UDT connection of the transfer. Nil if the UDT session is not yet established.
+func transferUDTConn(virtualConn *core.VirtualPacketConn) *udt.UDTSocket {
+	if fileStats, ok := virtualConn.Stats.(*core.FileTransferStats); ok {
+		return fileStats.UDTConn
+	} else if blockStats, ok := virtualConn.Stats.(*core.BlockTransferStats); ok {
+		return blockStats.UDTConn
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+/*
+File Name:  Signal.go
+Copyright:  2021 Peernet Foundation s.r.o.
+Author:     Peter Kleissner
+
+Handling of OS signals. SIGINT and SIGTERM initiate a graceful shutdown. SIGHUP reloads the API and log settings from the config file.
+*/
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/PeernetOfficial/core"
+)
+
+// signalMonitor handles OS signals until the application exits. A second SIGINT or SIGTERM during the shutdown exits immediately.
+func signalMonitor(backend *core.Backend, params *cmdParams) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGINT, syscall.SIGTERM:
+			if shutdownInProgress() {
+				backend.LogError("signalMonitor", "signal %s received during shutdown, exiting immediately\n", sig.String())
+				daemonStop()
+				os.Exit(ExitShutdownInterrupted)
+			}
+
+			go shutdownApplication(backend, "signal "+sig.String(), false)
+
+		case syscall.SIGHUP:
+			if shutdownInProgress() {
+				continue
+			}
+
+			backend.LogError("signalMonitor", "signal %s received, reloading settings from config file\n", sig.String())
+			sdNotify("RELOADING=1")
+			if err := reloadSettings(backend, params); err != nil {
+				sdNotify("READY=1\nSTATUS=Reload failed: " + err.Error())
+			} else {
+				sdNotify("READY=1\nSTATUS=Settings reloaded")
+			}
+		}
+	}
+}
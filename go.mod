@@ -5,18 +5,18 @@ go 1.18
 require (
 	github.com/PeernetOfficial/core v0.0.0-20221101165801-6989ef4a19c5
 	github.com/google/uuid v1.3.0
+	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.5.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/IncSW/geoip2 v0.1.2 // indirect
 	github.com/akrylysov/pogreb v0.10.1 // indirect
 	github.com/enfipy/locker v1.1.0 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.1 // indirect
 	golang.org/x/crypto v0.3.0 // indirect
 	golang.org/x/net v0.2.0 // indirect
 	golang.org/x/sys v0.2.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	lukechampine.com/blake3 v1.1.7 // indirect
 )